@@ -0,0 +1,253 @@
+package nfqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// DefaultAckTimeout limits the wait for an acknowledgment, if
+// Config.WriteTimeout is not set.
+const DefaultAckTimeout = time.Second
+
+// maxLateAcks bounds the number of verdicts, whose acknowledgments are
+// dropped, if they arrive after the verdict stopped waiting.
+const maxLateAcks = 1024
+
+// acks matches the acknowledgments of the kernel to the verdicts, that wait
+// for them.
+type acks struct {
+	logger  Logger
+	mu      sync.Mutex
+	seq     uint32
+	waiters map[uint32]chan error
+	// late contains the sequence numbers of verdicts, that stopped waiting
+	// for their acknowledgments.
+	late map[uint32]struct{}
+	// err is returned to verdicts, while acknowledgments are not received.
+	err error
+}
+
+func newAcks(logger Logger) *acks {
+	return &acks{
+		logger:  logger,
+		waiters: make(map[uint32]chan error),
+		late:    make(map[uint32]struct{}),
+		err:     ErrNotReceiving,
+	}
+}
+
+// add returns the sequence number for a verdict and the channel to wait on
+// for its acknowledgment.
+func (a *acks) add() (uint32, chan error, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return 0, nil, a.err
+	}
+	a.seq++
+	if a.seq == 0 {
+		// netlink.Conn replaces the sequence number 0.
+		a.seq++
+	}
+	ch := make(chan error, 1)
+	a.waiters[a.seq] = ch
+	return a.seq, ch, nil
+}
+
+func (a *acks) remove(seq uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.waiters, seq)
+	a.stopWaiting(seq)
+}
+
+// stopWaiting remembers, that the acknowledgment of seq might arrive late.
+// a.mu must be held.
+func (a *acks) stopWaiting(seq uint32) {
+	if len(a.late) >= maxLateAcks {
+		clear(a.late)
+	}
+	a.late[seq] = struct{}{}
+}
+
+// isLate reports whether seq belongs to a verdict, that stopped waiting for
+// its acknowledgment.
+func (a *acks) isLate(seq uint32) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.late[seq]
+	delete(a.late, seq)
+	return ok
+}
+
+// done passes err to the verdict with sequence number seq. It reports whether
+// a verdict was waiting for it.
+func (a *acks) done(seq uint32, err error) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ch, ok := a.waiters[seq]
+	if !ok {
+		return false
+	}
+	delete(a.waiters, seq)
+	ch <- err
+	return true
+}
+
+// start enables waiting for acknowledgments.
+func (a *acks) start() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.err = nil
+}
+
+// stop passes err to all waiting verdicts and to all following ones.
+func (a *acks) stop(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.err = err
+	a.fail(err)
+}
+
+// fail passes err to all waiting verdicts. a.mu must be held.
+func (a *acks) fail(err error) {
+	for seq, ch := range a.waiters {
+		delete(a.waiters, seq)
+		a.stopWaiting(seq)
+		ch <- err
+	}
+}
+
+// handle passes acknowledgments and errors of verdicts to the waiting
+// verdicts and returns the remaining messages and error. Errors, that do not
+// belong to a request, like an overrun of the receive buffer, might have
+// dropped acknowledgments. The waiting verdicts receive ErrAckLost then.
+// Acknowledgments and errors, that arrive after their verdict stopped
+// waiting, are dropped.
+func (a *acks) handle(msgs []netlink.Message, err error) ([]netlink.Message, error) {
+	var opError *netlink.OpError
+	isOpError := errors.As(err, &opError)
+	if isOpError && opError.Sequence != 0 {
+		if a.done(opError.Sequence, err) {
+			return nil, nil
+		}
+		if a.isLate(opError.Sequence) {
+			a.logger.Debugf("Dropped late error of verdict %d: %v", opError.Sequence, err)
+			return nil, nil
+		}
+	}
+	if err != nil && (!isOpError || opError.Sequence == 0) {
+		a.mu.Lock()
+		a.fail(fmt.Errorf("%w: %w", ErrAckLost, err))
+		a.mu.Unlock()
+	}
+	n := 0
+	for _, msg := range msgs {
+		// Errors are returned as err, so this is an acknowledgment.
+		if msg.Header.Type == netlink.Error {
+			if !a.done(msg.Header.Sequence, nil) {
+				a.isLate(msg.Header.Sequence)
+				a.logger.Debugf("Dropped acknowledgment %d without waiting verdict", msg.Header.Sequence)
+			}
+			continue
+		}
+		msgs[n] = msg
+		n++
+	}
+	return msgs[:n], err
+}
+
+// waitAck sends req and waits for its acknowledgment.
+func (nfqueue *Nfqueue) waitAck(req netlink.Message) error {
+	seq, ch, err := nfqueue.acks.add()
+	if err != nil {
+		return err
+	}
+	req.Header.Flags |= netlink.Acknowledge
+	req.Header.Sequence = seq
+	if _, err := nfqueue.Con.Send(req); err != nil {
+		nfqueue.acks.remove(seq)
+		return err
+	}
+
+	timer := time.NewTimer(nfqueue.ackTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-timer.C:
+		nfqueue.acks.remove(seq)
+		return ErrAckTimeout
+	}
+}
+
+type received struct {
+	msgs []netlink.Message
+	err  error
+}
+
+// startReceiver receives messages in its own goroutine, so acknowledgments
+// are received while the callback waits for them. All other messages are
+// returned by receive. stop ends receiving and fails all verdicts, that wait
+// for acknowledgments.
+func (nfqueue *Nfqueue) startReceiver(ctx context.Context) (receive func() ([]netlink.Message, error), stop func()) {
+	var (
+		mu       sync.Mutex
+		cond     = sync.NewCond(&mu)
+		backlog  []received
+		stopped  bool
+		finished = make(chan struct{})
+	)
+
+	go func() {
+		defer close(finished)
+		for {
+			msgs, err := nfqueue.acks.handle(nfqueue.Con.Receive())
+			if len(msgs) == 0 && err == nil {
+				continue
+			}
+			mu.Lock()
+			if stopped {
+				mu.Unlock()
+				return
+			}
+			backlog = append(backlog, received{msgs: msgs, err: err})
+			cond.Signal()
+			mu.Unlock()
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	receive = func() ([]netlink.Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for len(backlog) == 0 {
+			cond.Wait()
+		}
+		r := backlog[0]
+		backlog[0] = received{}
+		backlog = backlog[1:]
+		return r.msgs, r.err
+	}
+	stop = func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		// Interrupt a blocking Receive() call and restore the deadline for
+		// unbinding from the queue.
+		nfqueue.Con.SetReadDeadline(time.Now().Add(-1 * time.Second))
+		<-finished
+		if ctx.Err() == nil {
+			nfqueue.Con.SetReadDeadline(time.Time{})
+		}
+		nfqueue.acks.stop(ErrNotReceiving)
+	}
+	return receive, stop
+}
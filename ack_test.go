@@ -0,0 +1,104 @@
+package nfqueue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestAcks(t *testing.T) {
+	a := newAcks(new(devNull))
+	if _, _, err := a.add(); !errors.Is(err, ErrNotReceiving) {
+		t.Fatalf("unexpected error before start: %v", err)
+	}
+	a.start()
+
+	seqAck, chAck, err := a.add()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	seqErr, chErr, err := a.add()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, chStop, err := a.add()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	packet := netlink.Message{Header: netlink.Header{Type: nfqueueHeaderType(NfQnlMsgPacket)}}
+	msgs, err := a.handle([]netlink.Message{
+		packet,
+		{Header: netlink.Header{Type: netlink.Error, Sequence: seqAck}, Data: make([]byte, 4)},
+	}, nil)
+	if err != nil || len(msgs) != 1 || msgs[0].Header.Type != packet.Header.Type {
+		t.Errorf("unexpected remaining messages: %+v, %v", msgs, err)
+	}
+	if err := <-chAck; err != nil {
+		t.Errorf("unexpected error for acknowledgment: %v", err)
+	}
+
+	opError := &netlink.OpError{Op: "receive", Err: errors.New("no such file"), Sequence: seqErr}
+	if msgs, err := a.handle(nil, opError); err != nil || len(msgs) != 0 {
+		t.Errorf("error of verdict not consumed: %v", err)
+	}
+	if err := <-chErr; err != opError {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Errors of other messages are passed on.
+	opError = &netlink.OpError{Op: "receive", Err: errors.New("no such file"), Sequence: 4242}
+	if _, err := a.handle(nil, opError); err != opError {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	a.stop(ErrNotReceiving)
+	if err := <-chStop; !errors.Is(err, ErrNotReceiving) {
+		t.Errorf("unexpected error after stop: %v", err)
+	}
+}
+
+func TestAcksOverrun(t *testing.T) {
+	a := newAcks(new(devNull))
+	a.start()
+	seq, ch, err := a.add()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An overrun of the receive buffer does not belong to a request.
+	enobufs := errors.New("no buffer space available")
+	opError := &netlink.OpError{Op: "receive", Err: enobufs}
+	if _, err := a.handle(nil, opError); err != opError {
+		t.Errorf("unexpected error: %v", err)
+	}
+	select {
+	case err := <-ch:
+		if !errors.Is(err, ErrAckLost) || !errors.Is(err, enobufs) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	default:
+		t.Fatal("verdict still waits for acknowledgment")
+	}
+
+	// A late acknowledgment is not delivered, verdicts keep waiting for
+	// their acknowledgments.
+	msgs, err := a.handle([]netlink.Message{
+		{Header: netlink.Header{Type: netlink.Error, Sequence: seq}, Data: make([]byte, 4)},
+	}, nil)
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("unexpected remaining messages: %+v, %v", msgs, err)
+	}
+	seq, _, err = a.add()
+	if err != nil {
+		t.Errorf("unexpected error after overrun: %v", err)
+	}
+
+	// A late error of a verdict, that timed out, is not delivered.
+	a.remove(seq)
+	opError = &netlink.OpError{Op: "receive", Err: errors.New("no such file"), Sequence: seq}
+	if msgs, err := a.handle(nil, opError); err != nil || len(msgs) != 0 {
+		t.Errorf("unexpected late error: %+v, %v", msgs, err)
+	}
+}
@@ -4,141 +4,255 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/florianl/go-nfqueue/v2/internal/unix"
-
-	"github.com/mdlayher/netlink"
 )
 
-func extractAttribute(log Logger, a *Attribute, data []byte) error {
-	ad, err := netlink.NewAttributeDecoder(data)
-	if err != nil {
-		return err
+// attrScanner iterates over netlink attributes. Unlike
+// netlink.AttributeDecoder it does not copy the data of the attributes,
+// which allows to hand out views into the receive buffer.
+type attrScanner struct {
+	b    []byte
+	typ  uint16
+	data []byte
+	err  error
+}
+
+func newAttrScanner(b []byte) *attrScanner {
+	return &attrScanner{b: b}
+}
+
+func (as *attrScanner) next() bool {
+	if as.err != nil || len(as.b) == 0 {
+		return false
+	}
+	if len(as.b) < nlaHeaderLen {
+		as.typ = nfQaUnspec
+		as.err = fmt.Errorf("insufficient data for attribute header: %d", len(as.b))
+		return false
+	}
+	// struct nlattr is in native byte order
+	length := int(binary.NativeEndian.Uint16(as.b[0:2]))
+	as.typ = binary.NativeEndian.Uint16(as.b[2:4]) & nlaTypeMask
+	if length < nlaHeaderLen || length > len(as.b) {
+		as.err = fmt.Errorf("invalid attribute length %d: got %d", length, len(as.b))
+		return false
+	}
+	as.data = as.b[nlaHeaderLen:length]
+	as.b = as.b[min(nlaAlign(length), len(as.b)):]
+	return true
+}
+
+// bytes returns the data of the current attribute. Unless zeroCopy is set,
+// the data is copied.
+func (as *attrScanner) bytes(zeroCopy bool) []byte {
+	if zeroCopy {
+		return as.data
 	}
-	ad.ByteOrder = binary.BigEndian
-	for ad.Next() {
-		switch ad.Type() {
+	return bytes.Clone(as.data)
+}
+
+func (as *attrScanner) uint16() uint16 {
+	if len(as.data) != 2 {
+		as.err = fmt.Errorf("attribute 0x%x is not a uint16: length %d", as.typ, len(as.data))
+		return 0
+	}
+	return binary.BigEndian.Uint16(as.data)
+}
+
+func (as *attrScanner) uint32() uint32 {
+	if len(as.data) != 4 {
+		as.err = fmt.Errorf("attribute 0x%x is not a uint32: length %d", as.typ, len(as.data))
+		return 0
+	}
+	return binary.BigEndian.Uint32(as.data)
+}
+
+func (as *attrScanner) string() string {
+	return string(bytes.TrimSuffix(as.data, []byte{0x00}))
+}
+
+func nlaAlign(length int) int {
+	return (length + nlaAlignTo - 1) &^ (nlaAlignTo - 1)
+}
+
+func extractAttribute(log Logger, p *Packet, data []byte, zeroCopy bool) error {
+	as := newAttrScanner(data)
+	for as.next() {
+		switch as.typ {
 		case nfQaPacketHdr:
-			data := ad.Bytes()
+			data := as.data
 			if len(data) < 7 {
-				return fmt.Errorf("nfQaPacketHdr: insufficient data length: %d", len(data))
+				as.err = fmt.Errorf("nfQaPacketHdr: insufficient data length: %d", len(data))
+				continue
 			}
-			packetID := binary.BigEndian.Uint32(data[:4])
-			a.PacketID = &packetID
-			hwProto := binary.BigEndian.Uint16(data[4:6])
-			a.HwProtocol = &hwProto
-			hook := uint8(data[6])
-			a.Hook = &hook
+			p.PacketID = binary.BigEndian.Uint32(data[:4])
+			p.HwProtocol = binary.BigEndian.Uint16(data[4:6])
+			p.Hook = Hook(data[6])
+			p.fields |= FieldPacketID | FieldHwProtocol | FieldHook
 		case nfQaMark:
-			mark := ad.Uint32()
-			a.Mark = &mark
+			p.Mark = as.uint32()
+			p.fields |= FieldMark
 		case nfQaTimestamp:
-			data := ad.Bytes()
+			data := as.data
 			if len(data) < 16 {
-				return fmt.Errorf("nfQaTimestamp: insufficient data length: %d", len(data))
-			}
-			var sec, usec int64
-			r := bytes.NewReader(data[:8])
-			if err := binary.Read(r, binary.BigEndian, &sec); err != nil {
-				return err
-			}
-			r = bytes.NewReader(data[8:])
-			if err := binary.Read(r, binary.BigEndian, &usec); err != nil {
-				return err
+				as.err = fmt.Errorf("nfQaTimestamp: insufficient data length: %d", len(data))
+				continue
 			}
-			timestamp := time.Unix(sec, usec*1000)
-			a.Timestamp = &timestamp
+			sec := int64(binary.BigEndian.Uint64(data[:8]))
+			usec := int64(binary.BigEndian.Uint64(data[8:16]))
+			p.Timestamp = time.Unix(sec, usec*1000)
+			p.fields |= FieldTimestamp
 		case nfQaIfIndexInDev:
-			inDev := ad.Uint32()
-			a.InDev = &inDev
+			p.InDev = as.uint32()
+			p.fields |= FieldInDev
 		case nfQaIfIndexOutDev:
-			outDev := ad.Uint32()
-			a.OutDev = &outDev
+			p.OutDev = as.uint32()
+			p.fields |= FieldOutDev
 		case nfQaIfIndexPhysInDev:
-			physInDev := ad.Uint32()
-			a.PhysInDev = &physInDev
+			p.PhysInDev = as.uint32()
+			p.fields |= FieldPhysInDev
 		case nfQaIfIndexPhysOutDev:
-			physOutDev := ad.Uint32()
-			a.PhysOutDev = &physOutDev
+			p.PhysOutDev = as.uint32()
+			p.fields |= FieldPhysOutDev
 		case nfQaHwAddr:
-			data := ad.Bytes()
+			data := as.data
 			if len(data) < 4 {
-				return fmt.Errorf("nfQaHwAddr: insufficient data length: %d", len(data))
+				as.err = fmt.Errorf("nfQaHwAddr: insufficient data length: %d", len(data))
+				continue
 			}
 			hwAddrLen := binary.BigEndian.Uint16(data[:2])
 			if len(data) < int(4+hwAddrLen) {
-				return fmt.Errorf("nfQaHwAddr: insufficient data for hwAddrLen %d: got %d", hwAddrLen, len(data))
+				as.err = fmt.Errorf("nfQaHwAddr: insufficient data for hwAddrLen %d: got %d", hwAddrLen, len(data))
+				continue
 			}
-			hwAddr := bytes.Clone(data[4 : 4+hwAddrLen])
-			a.HwAddr = &hwAddr
+			p.HwAddr = net.HardwareAddr(data[4 : 4+hwAddrLen])
+			if !zeroCopy {
+				p.HwAddr = bytes.Clone(p.HwAddr)
+			}
+			p.fields |= FieldHwAddr
 		case nfQaPayload:
-			payload := bytes.Clone(ad.Bytes())
-			a.Payload = &payload
+			p.Payload = as.bytes(zeroCopy)
+			p.fields |= FieldPayload
 		case nfQaCt:
-			ct := bytes.Clone(ad.Bytes())
-			a.Ct = &ct
+			p.Ct = as.bytes(zeroCopy)
+			p.fields |= FieldCt
 		case nfQaCtInfo:
-			ctInfo := ad.Uint32()
-			a.CtInfo = &ctInfo
+			p.CtInfo = CtInfo(as.uint32())
+			p.fields |= FieldCtInfo
 		case nfQaCapLen:
-			capLen := ad.Uint32()
-			a.CapLen = &capLen
+			p.CapLen = as.uint32()
+			p.fields |= FieldCapLen
 		case nfQaSkbInfo:
-			skbInfo := bytes.Clone(ad.Bytes())
-			a.SkbInfo = &skbInfo
+			p.SkbInfo = as.bytes(zeroCopy)
+			p.fields |= FieldSkbInfo
 		case nfQaExp:
-			exp := bytes.Clone(ad.Bytes())
-			a.Exp = &exp
+			p.Exp = as.bytes(zeroCopy)
+			p.fields |= FieldExp
 		case nfQaUID:
-			uid := ad.Uint32()
-			a.UID = &uid
+			p.UID = as.uint32()
+			p.fields |= FieldUID
 		case nfQaGID:
-			gid := ad.Uint32()
-			a.GID = &gid
+			p.GID = as.uint32()
+			p.fields |= FieldGID
 		case nfQaSecCtx:
-			secCtx := ad.String()
-			a.SecCtx = &secCtx
+			p.SecCtx = as.string()
+			p.fields |= FieldSecCtx
 		case nfQaL2HDR:
-			l2hdr := bytes.Clone(ad.Bytes())
-			a.L2Hdr = &l2hdr
+			p.L2Hdr = as.bytes(zeroCopy)
+			p.fields |= FieldL2Hdr
 		case nfQaPriority:
-			skbPrio := ad.Uint32()
-			a.SkbPrio = &skbPrio
+			p.SkbPrio = as.uint32()
+			p.fields |= FieldSkbPrio
+		case nfQaVLAN:
+			if err := extractVLAN(&p.VLAN, as.data); err != nil {
+				as.err = err
+				continue
+			}
+			p.fields |= FieldVLAN
 		default:
-			log.Errorf("Unknown attribute Type: 0x%x\tData: %v", ad.Type(), ad.Bytes())
+			log.Debugf("Unknown attribute Type: 0x%x\tData: %v", as.typ, as.data)
+			if p.Unknown == nil {
+				p.Unknown = make(map[uint16][]byte)
+			}
+			p.Unknown[as.typ] = as.bytes(zeroCopy)
 		}
 	}
 
-	return ad.Err()
+	if as.err != nil {
+		return newParseError(p, data, as.typ, as.err)
+	}
+	return nil
+}
+
+// newParseError returns a ParseError for err. If the packet ID was not
+// decoded yet, it is looked up in the attributes attrs.
+func newParseError(p *Packet, attrs []byte, typ uint16, err error) *ParseError {
+	pe := &ParseError{AttrType: typ, Err: err}
+	if p.Has(FieldPacketID) {
+		pe.PacketID, pe.HasPacketID = p.PacketID, true
+		return pe
+	}
+	as := newAttrScanner(attrs)
+	for as.next() {
+		if as.typ == nfQaPacketHdr && len(as.data) >= 4 {
+			pe.PacketID, pe.HasPacketID = binary.BigEndian.Uint32(as.data[:4]), true
+			break
+		}
+	}
+	return pe
+}
+
+func extractVLAN(v *VLAN, data []byte) error {
+	as := newAttrScanner(data)
+	for as.next() {
+		switch as.typ {
+		case nfQaVLANProto:
+			v.TPID = as.uint16()
+		case nfQaVLANTCI:
+			v.TCI = as.uint16()
+		}
+	}
+	return as.err
+}
+
+// isSupportedFamily reports whether packets of the given protocol family
+// can be queued to userspace.
+func isSupportedFamily(family uint8) bool {
+	switch family {
+	case unix.AF_INET, unix.AF_INET6, unix.NFPROTO_BRIDGE:
+		return true
+	}
+	return false
 }
 
 func checkHeader(data []byte) (int, error) {
 	if len(data) < 2 {
 		return 0, fmt.Errorf("too less data for header")
 	}
-	if (data[0] == unix.AF_INET || data[0] == unix.AF_INET6) && data[1] == unix.NFNETLINK_V0 {
+	if isSupportedFamily(data[0]) && data[1] == unix.NFNETLINK_V0 {
 		return 4, nil
 	}
 	return 0, fmt.Errorf("invalid header %#v", data[:2])
 }
 
-func extractAttributes(log Logger, msg []byte) (Attribute, error) {
-	attrs := Attribute{}
-
+func extractPacket(log Logger, p *Packet, msg []byte, zeroCopy bool) error {
 	if len(msg) == 0 {
-		return attrs, nil
+		return nil
 	}
 
 	offset, err := checkHeader(msg)
 	if err != nil {
-		return attrs, err
+		return newParseError(p, nil, nfQaUnspec, err)
 	}
 	if offset >= len(msg) {
-		return attrs, fmt.Errorf("too less data for attribute")
-	}
-	if err := extractAttribute(log, &attrs, msg[offset:]); err != nil {
-		return attrs, err
+		return newParseError(p, nil, nfQaUnspec, fmt.Errorf("too less data for attribute"))
 	}
-	return attrs, nil
+	// /include/uapi/linux/netfilter/nfnetlink.h:struct nfgenmsg{} res_id is Big Endian
+	p.Family = msg[0]
+	p.QueueNum = binary.BigEndian.Uint16(msg[2:4])
+	p.fields |= FieldFamily | FieldQueueNum
+	return extractAttribute(log, p, msg[offset:], zeroCopy)
 }
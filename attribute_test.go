@@ -0,0 +1,229 @@
+package nfqueue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func marshalTestMsg(t *testing.T, attrs []netlink.Attribute) []byte {
+	t.Helper()
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		t.Fatalf("failed to encode attributes: %v", err)
+	}
+	// struct nfgenmsg for AF_INET, queue 100
+	return append([]byte{0x02, 0x00, 0x00, 0x64}, data...)
+}
+
+func TestExtractAttributes(t *testing.T) {
+	vlan, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfQaVLANProto, Data: []byte{0x81, 0x00}},
+		{Type: nfQaVLANTCI, Data: []byte{0xb0, 0x2a}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		attrs []netlink.Attribute
+		check func(t *testing.T, a Attribute)
+	}{
+		"packet header": {
+			attrs: []netlink.Attribute{
+				{Type: nfQaPacketHdr, Data: []byte{0x00, 0x00, 0x00, 0x2a, 0x08, 0x00, 0x03}},
+			},
+			check: func(t *testing.T, a Attribute) {
+				if a.PacketID == nil || *a.PacketID != 42 {
+					t.Errorf("unexpected PacketID: %v", a.PacketID)
+				}
+				if a.HwProtocol == nil || *a.HwProtocol != 0x0800 {
+					t.Errorf("unexpected HwProtocol: %v", a.HwProtocol)
+				}
+				if a.Hook == nil || *a.Hook != HookLocalOut || a.Hook.Name(*a.Family) != "OUTPUT" {
+					t.Errorf("unexpected Hook: %v", a.Hook)
+				}
+				if a.Family == nil || *a.Family != 0x02 {
+					t.Errorf("unexpected Family: %v", a.Family)
+				}
+				if a.QueueNum == nil || *a.QueueNum != 100 {
+					t.Errorf("unexpected QueueNum: %v", a.QueueNum)
+				}
+			},
+		},
+		"vlan": {
+			attrs: []netlink.Attribute{
+				{Type: netlink.Nested | nfQaVLAN, Data: vlan},
+			},
+			check: func(t *testing.T, a Attribute) {
+				if a.VLAN == nil {
+					t.Fatal("VLAN not decoded")
+				}
+				if a.VLAN.TPID != 0x8100 {
+					t.Errorf("unexpected VLAN TPID: %#x", a.VLAN.TPID)
+				}
+				if id := a.VLAN.ID(); id != 42 {
+					t.Errorf("unexpected VLAN ID: %d", id)
+				}
+				if prio := a.VLAN.Priority(); prio != 5 {
+					t.Errorf("unexpected VLAN priority: %d", prio)
+				}
+				if !a.VLAN.DEI() {
+					t.Errorf("expected DEI to be set")
+				}
+			},
+		},
+		"unknown": {
+			attrs: []netlink.Attribute{
+				{Type: nfQaMark, Data: []byte{0x00, 0x00, 0x00, 0x01}},
+				{Type: 0x30, Data: []byte{0xca, 0xfe}},
+			},
+			check: func(t *testing.T, a Attribute) {
+				if a.Mark == nil || *a.Mark != 1 {
+					t.Errorf("unexpected Mark: %v", a.Mark)
+				}
+				if len(a.Unknown) != 1 || string(a.Unknown[0x30]) != "\xca\xfe" {
+					t.Errorf("unexpected Unknown: %v", a.Unknown)
+				}
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := new(Packet)
+			if err := extractPacket(new(devNull), p, marshalTestMsg(t, tc.attrs), false); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tc.check(t, p.Attribute())
+		})
+	}
+}
+
+func TestExtractAttributesZeroCopy(t *testing.T) {
+	msg := marshalTestMsg(t, []netlink.Attribute{
+		{Type: nfQaPacketHdr, Data: []byte{0x00, 0x00, 0x00, 0x2a, 0x08, 0x00, 0x03}},
+		{Type: nfQaPayload, Data: []byte{0x45, 0x00, 0x00, 0x14}},
+	})
+
+	for _, zeroCopy := range []bool{false, true} {
+		p := new(Packet)
+		if err := extractPacket(new(devNull), p, msg, zeroCopy); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !p.Has(FieldPacketID|FieldPayload) || len(p.Payload) != 4 {
+			t.Fatalf("unexpected payload: %v", p.Payload)
+		}
+		if p.Has(FieldMark) {
+			t.Errorf("unexpected mark: %d", p.Mark)
+		}
+		shared := &p.Payload[0] == &msg[len(msg)-4]
+		if shared != zeroCopy {
+			t.Errorf("zeroCopy %t: payload shares memory with message: %t", zeroCopy, shared)
+		}
+	}
+}
+
+func TestExtractPacketParseError(t *testing.T) {
+	pktHdr := netlink.Attribute{Type: nfQaPacketHdr, Data: []byte{0x00, 0x00, 0x00, 0x2a, 0x08, 0x00, 0x03}}
+
+	tests := map[string]struct {
+		msg         []byte
+		attrType    uint16
+		hasPacketID bool
+	}{
+		"invalid mark": {
+			msg:         marshalTestMsg(t, []netlink.Attribute{pktHdr, {Type: nfQaMark, Data: []byte{0x00, 0x01}}}),
+			attrType:    nfQaMark,
+			hasPacketID: true,
+		},
+		"packet header after invalid timestamp": {
+			msg:         marshalTestMsg(t, []netlink.Attribute{{Type: nfQaTimestamp, Data: []byte{0x00}}, pktHdr}),
+			attrType:    nfQaTimestamp,
+			hasPacketID: true,
+		},
+		"invalid packet header": {
+			msg:      marshalTestMsg(t, []netlink.Attribute{{Type: nfQaPacketHdr, Data: []byte{0x00, 0x00}}}),
+			attrType: nfQaPacketHdr,
+		},
+		"invalid header": {
+			msg: []byte{0x03, 0x00, 0x00, 0x64, 0x00},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := extractPacket(new(devNull), new(Packet), tc.msg, false)
+			var parseError *ParseError
+			if !errors.As(err, &parseError) {
+				t.Fatalf("expected ParseError, got %v", err)
+			}
+			if parseError.AttrType != tc.attrType {
+				t.Errorf("unexpected attribute type: 0x%x", parseError.AttrType)
+			}
+			if parseError.HasPacketID != tc.hasPacketID || (tc.hasPacketID && parseError.PacketID != 42) {
+				t.Errorf("unexpected packet ID: %d, %t", parseError.PacketID, parseError.HasPacketID)
+			}
+			if errors.Unwrap(err) == nil {
+				t.Error("expected wrapped error")
+			}
+		})
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	tests := map[string]struct {
+		data    []byte
+		wantErr bool
+	}{
+		"ipv4":        {data: []byte{0x02, 0x00, 0x00, 0x64}},
+		"ipv6":        {data: []byte{0x0a, 0x00, 0x00, 0x64}},
+		"bridge":      {data: []byte{0x07, 0x00, 0x00, 0x64}},
+		"arp":         {data: []byte{0x03, 0x00, 0x00, 0x64}, wantErr: true},
+		"version":     {data: []byte{0x02, 0x01, 0x00, 0x64}, wantErr: true},
+		"insufficent": {data: []byte{0x02}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := checkHeader(tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkExtractAttributes(b *testing.B) {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfQaPacketHdr, Data: []byte{0x00, 0x00, 0x00, 0x2a, 0x08, 0x00, 0x03}},
+		{Type: nfQaMark, Data: []byte{0x00, 0x00, 0x00, 0x01}},
+		{Type: nfQaTimestamp, Data: make([]byte, 16)},
+		{Type: nfQaIfIndexOutDev, Data: []byte{0x00, 0x00, 0x00, 0x02}},
+		{Type: nfQaPayload, Data: make([]byte, 1500)},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := append([]byte{0x02, 0x00, 0x00, 0x64}, data...)
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := extractPacket(new(devNull), new(Packet), msg, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("zerocopy", func(b *testing.B) {
+		b.ReportAllocs()
+		p := new(Packet)
+		for b.Loop() {
+			*p = Packet{}
+			if err := extractPacket(new(devNull), p, msg, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,327 @@
+package nfqueue
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Defaults of BatchConfig.
+const (
+	DefaultBatchMaxCount = 64
+	DefaultBatchMaxDelay = time.Millisecond
+	DefaultBatchMaxAge   = 10 * time.Second
+)
+
+// BatchConfig contains options for the batching of verdicts.
+type BatchConfig struct {
+	// MaxCount is the maximum number of packets a batch verdict covers. If not
+	// set, DefaultBatchMaxCount is used.
+	MaxCount int
+
+	// MaxDelay is the maximum time a verdict is held back. If not set,
+	// DefaultBatchMaxDelay is used.
+	MaxDelay time.Duration
+
+	// MaxAge is the time after which a packet without a verdict is assumed
+	// to be dropped by the kernel, e.g. as its device went down. Later batch
+	// verdicts apply to the packet, if it is still queued. If not set,
+	// DefaultBatchMaxAge is used.
+	MaxAge time.Duration
+}
+
+// Batcher merges identical verdicts for consecutive packets into batch
+// verdicts.
+//
+// A batch verdict applies to all queued packets up to its ID. The receive loop
+// therefore registers the ID of every queued packet with the Batcher, and
+// verdicts are only merged for packets in front of the first packet without a
+// verdict. A batch is sent, when it covers MaxCount packets, when a different
+// verdict follows or after MaxDelay. Verdicts for packets behind a packet
+// without a verdict are sent one by one after MaxDelay.
+//
+// Verdicts, that are set via Nfqueue.SetPacketVerdict and
+// Nfqueue.SetPacketVerdictBatch, remove the packets from the Batcher. Packets,
+// that never get a verdict, hold back the batching of all following packets
+// until MaxAge.
+type Batcher struct {
+	send     func(VerdictMessage) error
+	logger   Logger
+	maxCount int
+	maxDelay time.Duration
+	maxAge   time.Duration
+
+	mu sync.Mutex
+	// entries of the queued packets in the order of their IDs
+	entries []*batchEntry
+	byID    map[uint32]*batchEntry
+	// number of entries with a verdict
+	decided int
+	timer   *time.Timer
+	closed  bool
+	// number of tickets handed out to send verdicts
+	tickets uint64
+
+	// Verdicts are sent without holding mu, as waiting for acknowledgments
+	// would block the registration of queued packets. Tickets keep the
+	// order of the verdicts.
+	sendMu   sync.Mutex
+	sendCond *sync.Cond
+	served   uint64
+}
+
+type batchEntry struct {
+	id         uint32
+	verdict    Verdict
+	decided    bool
+	registered time.Time
+}
+
+func newBatcher(send func(VerdictMessage) error, logger Logger, config BatchConfig) *Batcher {
+	b := &Batcher{
+		send:     send,
+		logger:   logger,
+		maxCount: config.MaxCount,
+		maxDelay: config.MaxDelay,
+		maxAge:   config.MaxAge,
+		byID:     make(map[uint32]*batchEntry),
+	}
+	b.sendCond = sync.NewCond(&b.sendMu)
+	if b.maxCount <= 0 {
+		b.maxCount = DefaultBatchMaxCount
+	}
+	if b.maxDelay <= 0 {
+		b.maxDelay = DefaultBatchMaxDelay
+	}
+	if b.maxAge <= 0 {
+		b.maxAge = DefaultBatchMaxAge
+	}
+	return b
+}
+
+// register adds the ID of a queued packet.
+func (b *Batcher) register(id uint32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.byID[id]; ok {
+		return
+	}
+	now := time.Now()
+	b.age(now)
+	e := &batchEntry{id: id, registered: now}
+	b.entries = append(b.entries, e)
+	b.byID[id] = e
+}
+
+// age removes the packets without a verdict, that were registered more than
+// maxAge ago. b.mu must be held.
+func (b *Batcher) age(now time.Time) {
+	n := 0
+	for n < len(b.entries) && now.Sub(b.entries[n].registered) >= b.maxAge {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	entries := make([]*batchEntry, 0, len(b.entries))
+	for i, e := range b.entries {
+		if i < n && !e.decided {
+			delete(b.byID, e.id)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	b.entries = entries
+}
+
+// forget removes the packet id, or all packets up to id for a batch verdict,
+// after its verdict was set without the Batcher.
+func (b *Batcher) forget(id uint32, batch bool) error {
+	b.mu.Lock()
+	if !batch {
+		if e, ok := b.byID[id]; ok {
+			b.remove(e)
+		}
+		return b.sendUnlock(b.flush(false))
+	}
+	n := 0
+	// The kernel compares IDs the same way for batch verdicts.
+	for n < len(b.entries) && int32(id-b.entries[n].id) >= 0 {
+		e := b.entries[n]
+		delete(b.byID, e.id)
+		if e.decided {
+			b.decided--
+		}
+		n++
+	}
+	clear(b.entries[:n])
+	b.entries = b.entries[n:]
+	return b.sendUnlock(b.flush(false))
+}
+
+// remove deletes the entry e. b.mu must be held.
+func (b *Batcher) remove(e *batchEntry) {
+	delete(b.byID, e.id)
+	if e.decided {
+		b.decided--
+	}
+	b.entries = slices.DeleteFunc(b.entries, func(x *batchEntry) bool {
+		return x == e
+	})
+}
+
+// SetVerdict sets the verdict for the packet id. The verdict for a packet,
+// that was not registered by the receive loop, is sent immediately.
+func (b *Batcher) SetVerdict(id uint32, verdict Verdict) error {
+	if !verdict.Valid() {
+		return ErrInvalidVerdict
+	}
+	b.mu.Lock()
+	e, ok := b.byID[id]
+	if !ok || b.closed {
+		return b.sendUnlock([]VerdictMessage{{ID: id, Verdict: verdict}})
+	}
+	if !e.decided {
+		e.decided = true
+		b.decided++
+	}
+	e.verdict = verdict
+	return b.sendUnlock(b.flush(false))
+}
+
+// SetPacketVerdict sets the verdict for the packet id like SetVerdict. If
+// options are given, the verdict can not be batched and is sent immediately.
+// SetPacketVerdict allows to use the Batcher as Verdicter of the packages
+// defrag and stream.
+func (b *Batcher) SetPacketVerdict(id uint32, verdict Verdict, options ...VerdictOption) error {
+	if len(options) == 0 {
+		return b.SetVerdict(id, verdict)
+	}
+	if !verdict.Valid() {
+		return ErrInvalidVerdict
+	}
+	vo := &verdictOptions{msg: VerdictMessage{ID: id, Verdict: verdict}}
+	for _, opt := range options {
+		if err := opt(vo); err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	if e, ok := b.byID[id]; ok {
+		b.remove(e)
+	}
+	// Batches, that follow, cover the packet, but are sent after its verdict.
+	return b.sendUnlock(append([]VerdictMessage{vo.msg}, b.flush(false)...))
+}
+
+// Flush sends all verdicts, that are held back.
+func (b *Batcher) Flush() error {
+	b.mu.Lock()
+	return b.sendUnlock(b.flush(true))
+}
+
+// close sends all verdicts, that are held back, and stops the Batcher.
+func (b *Batcher) close() error {
+	b.mu.Lock()
+	b.closed = true
+	return b.sendUnlock(b.flush(true))
+}
+
+func (b *Batcher) expire() {
+	b.mu.Lock()
+	b.timer = nil
+	if err := b.sendUnlock(b.flush(true)); err != nil {
+		b.logger.Errorf("Could not set batched verdicts: %v", err)
+	}
+}
+
+// sendUnlock releases b.mu and sends msgs after the verdicts of earlier
+// calls. b.mu must be held.
+func (b *Batcher) sendUnlock(msgs []VerdictMessage) error {
+	if len(msgs) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	ticket := b.tickets
+	b.tickets++
+	b.mu.Unlock()
+
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	for b.served != ticket {
+		b.sendCond.Wait()
+	}
+	var errs []error
+	for _, m := range msgs {
+		errs = append(errs, b.send(m))
+	}
+	b.served++
+	b.sendCond.Broadcast()
+	return errors.Join(errs...)
+}
+
+// flush returns the verdicts for the packets in front of the first packet
+// without a verdict. Unless all is set, the last batch is held back until it
+// covers maxCount packets, as following verdicts might extend it. If all is
+// set, the verdicts for packets behind a packet without a verdict are
+// returned as well. b.mu must be held.
+func (b *Batcher) flush(all bool) []VerdictMessage {
+	var msgs []VerdictMessage
+
+	b.age(time.Now())
+
+	n := 0
+	for n < len(b.entries) && b.entries[n].decided {
+		n++
+	}
+	start := 0
+	for start < n {
+		end := start + 1
+		for end < n && end-start < b.maxCount && b.entries[end].verdict == b.entries[start].verdict {
+			end++
+		}
+		if end == n && end-start < b.maxCount && !all {
+			break
+		}
+		last := b.entries[end-1]
+		msgs = append(msgs, VerdictMessage{ID: last.id, Verdict: last.verdict, Batch: end-start > 1})
+		start = end
+	}
+	for _, e := range b.entries[:start] {
+		delete(b.byID, e.id)
+	}
+	b.decided -= start
+	b.entries = b.entries[start:]
+
+	if all {
+		entries := b.entries[:0]
+		for _, e := range b.entries {
+			if !e.decided {
+				entries = append(entries, e)
+				continue
+			}
+			msgs = append(msgs, VerdictMessage{ID: e.id, Verdict: e.verdict})
+			delete(b.byID, e.id)
+			b.decided--
+		}
+		clear(b.entries[len(entries):])
+		b.entries = entries
+	}
+
+	b.schedule()
+	return msgs
+}
+
+// schedule starts the timer for verdicts, that are held back, and stops it,
+// if there are none. b.mu must be held.
+func (b *Batcher) schedule() {
+	held := b.decided > 0
+	switch {
+	case held && b.timer == nil && !b.closed:
+		b.timer = time.AfterFunc(b.maxDelay, b.expire)
+	case !held && b.timer != nil:
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
@@ -0,0 +1,271 @@
+package nfqueue
+
+import (
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSender struct {
+	mu   sync.Mutex
+	msgs []VerdictMessage
+}
+
+func (s *testSender) send(v VerdictMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, v)
+	return nil
+}
+
+func (s *testSender) sent() []VerdictMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.msgs)
+}
+
+func equalVerdicts(a, b []VerdictMessage) bool {
+	return slices.EqualFunc(a, b, func(x, y VerdictMessage) bool {
+		return reflect.DeepEqual(x, y)
+	})
+}
+
+func TestBatcher(t *testing.T) {
+	type verdict struct {
+		id      uint32
+		verdict Verdict
+	}
+
+	tests := map[string]struct {
+		maxCount int
+		verdicts []verdict
+		// messages sent before Flush()
+		want []VerdictMessage
+		// messages sent by Flush()
+		flushed []VerdictMessage
+	}{
+		"merge": {
+			verdicts: []verdict{{1, NfAccept}, {2, NfAccept}, {3, NfAccept}},
+			flushed:  []VerdictMessage{{ID: 3, Verdict: NfAccept, Batch: true}},
+		},
+		"verdict change": {
+			verdicts: []verdict{{1, NfAccept}, {2, NfAccept}, {3, NfDrop}, {4, NfAccept}},
+			want: []VerdictMessage{
+				{ID: 2, Verdict: NfAccept, Batch: true},
+				{ID: 3, Verdict: NfDrop},
+			},
+			flushed: []VerdictMessage{{ID: 4, Verdict: NfAccept}},
+		},
+		"max count": {
+			maxCount: 2,
+			verdicts: []verdict{{1, NfAccept}, {2, NfAccept}, {3, NfAccept}},
+			want:     []VerdictMessage{{ID: 2, Verdict: NfAccept, Batch: true}},
+			flushed:  []VerdictMessage{{ID: 3, Verdict: NfAccept}},
+		},
+		"pending": {
+			verdicts: []verdict{{2, NfAccept}, {3, NfDrop}, {5, NfDrop}, {1, NfAccept}},
+			want:     []VerdictMessage{{ID: 2, Verdict: NfAccept, Batch: true}},
+			flushed: []VerdictMessage{
+				{ID: 3, Verdict: NfDrop},
+				{ID: 5, Verdict: NfDrop},
+			},
+		},
+		"unregistered": {
+			verdicts: []verdict{{42, NfDrop}, {1, NfAccept}},
+			want:     []VerdictMessage{{ID: 42, Verdict: NfDrop}},
+			flushed:  []VerdictMessage{{ID: 1, Verdict: NfAccept}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := new(testSender)
+			b := newBatcher(s.send, new(devNull), BatchConfig{MaxCount: tc.maxCount, MaxDelay: time.Hour})
+			for id := uint32(1); id <= 5; id++ {
+				b.register(id)
+			}
+			for _, v := range tc.verdicts {
+				if err := b.SetVerdict(v.id, v.verdict); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if msgs := s.sent(); !equalVerdicts(msgs, tc.want) {
+				t.Errorf("unexpected verdicts: %+v", msgs)
+			}
+			if err := b.Flush(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if msgs := s.sent()[len(tc.want):]; !equalVerdicts(msgs, tc.flushed) {
+				t.Errorf("unexpected flushed verdicts: %+v", msgs)
+			}
+			if b.timer != nil {
+				t.Error("timer still running")
+			}
+		})
+	}
+}
+
+func TestBatcherMaxDelay(t *testing.T) {
+	s := new(testSender)
+	b := newBatcher(s.send, new(devNull), BatchConfig{MaxDelay: 10 * time.Millisecond})
+	for id := uint32(1); id <= 4; id++ {
+		b.register(id)
+	}
+	for _, id := range []uint32{1, 2, 4} {
+		if err := b.SetVerdict(id, NfAccept); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := b.SetVerdict(5, 42); err != ErrInvalidVerdict {
+		t.Errorf("unexpected error for invalid verdict: %v", err)
+	}
+
+	want := []VerdictMessage{
+		{ID: 2, Verdict: NfAccept, Batch: true},
+		{ID: 4, Verdict: NfAccept},
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(s.sent()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if msgs := s.sent(); !equalVerdicts(msgs, want) {
+		t.Errorf("unexpected verdicts: %+v", msgs)
+	}
+}
+
+func TestBatcherBlockingSend(t *testing.T) {
+	s := new(testSender)
+	sending := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	b := newBatcher(func(v VerdictMessage) error {
+		// The first verdict waits, e.g. for its acknowledgment.
+		once.Do(func() {
+			close(sending)
+			<-unblock
+		})
+		return s.send(v)
+	}, new(devNull), BatchConfig{MaxDelay: time.Hour})
+
+	errs := make(chan error, 2)
+	go func() { errs <- b.SetVerdict(1, NfDrop) }()
+	<-sending
+	go func() { errs <- b.SetVerdict(2, NfAccept) }()
+
+	registered := make(chan struct{})
+	go func() {
+		b.register(3)
+		close(registered)
+	}()
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		t.Fatal("register blocked by sending verdict")
+	}
+
+	close(unblock)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	want := []VerdictMessage{{ID: 1, Verdict: NfDrop}, {ID: 2, Verdict: NfAccept}}
+	if msgs := s.sent(); !equalVerdicts(msgs, want) {
+		t.Errorf("unexpected verdicts: %+v", msgs)
+	}
+}
+
+func TestBatcherForget(t *testing.T) {
+	s := new(testSender)
+	b := newBatcher(s.send, new(devNull), BatchConfig{MaxDelay: time.Hour})
+	for id := uint32(1); id <= 6; id++ {
+		b.register(id)
+	}
+
+	// Packet 1 gets its verdict without the Batcher.
+	if err := b.SetVerdict(2, NfAccept); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.forget(1, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Packets up to 4 get a batch verdict without the Batcher.
+	if err := b.SetVerdict(5, NfAccept); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.forget(4, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.SetVerdict(6, NfAccept); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The verdict for packet 2 is superseded by the batch verdict up to 4.
+	want := []VerdictMessage{{ID: 6, Verdict: NfAccept, Batch: true}}
+	if msgs := s.sent(); !equalVerdicts(msgs, want) {
+		t.Errorf("unexpected verdicts: %+v", msgs)
+	}
+	if len(b.entries) != 0 || len(b.byID) != 0 || b.decided != 0 {
+		t.Errorf("unexpected entries: %d, %d, %d", len(b.entries), len(b.byID), b.decided)
+	}
+}
+
+func TestBatcherMaxAge(t *testing.T) {
+	s := new(testSender)
+	b := newBatcher(s.send, new(devNull), BatchConfig{MaxDelay: time.Hour, MaxAge: time.Hour})
+	for id := uint32(1); id <= 3; id++ {
+		b.register(id)
+	}
+	// The kernel dropped packet 1.
+	b.entries[0].registered = time.Now().Add(-time.Hour)
+
+	for _, id := range []uint32{2, 3} {
+		if err := b.SetVerdict(id, NfAccept); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []VerdictMessage{{ID: 3, Verdict: NfAccept, Batch: true}}
+	if msgs := s.sent(); !equalVerdicts(msgs, want) {
+		t.Errorf("unexpected verdicts: %+v", msgs)
+	}
+	if _, ok := b.byID[1]; ok {
+		t.Error("expired packet still registered")
+	}
+}
+
+func TestBatcherSetPacketVerdict(t *testing.T) {
+	s := new(testSender)
+	b := newBatcher(s.send, new(devNull), BatchConfig{MaxDelay: time.Hour})
+	for id := uint32(1); id <= 3; id++ {
+		b.register(id)
+	}
+	if err := b.SetPacketVerdict(1, NfAccept); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.SetPacketVerdict(2, NfAccept, WithMark(7)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.SetPacketVerdict(3, NfAccept); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mark := uint32(7)
+	want := []VerdictMessage{
+		{ID: 2, Verdict: NfAccept, Mark: &mark},
+		{ID: 3, Verdict: NfAccept, Batch: true},
+	}
+	if msgs := s.sent(); !equalVerdicts(msgs, want) {
+		t.Errorf("unexpected verdicts: %+v", msgs)
+	}
+}
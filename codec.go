@@ -0,0 +1,402 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+	"github.com/mdlayher/netlink"
+)
+
+// MessageType is the type of a message of the nfqueue subsystem.
+type MessageType uint8
+
+// Message types of the nfqueue subsystem
+const (
+	NfQnlMsgPacket       MessageType = nfQnlMsgPacket
+	NfQnlMsgVerdict      MessageType = nfQnlMsgVerdict
+	NfQnlMsgConfig       MessageType = nfQnlMsgConfig
+	NfQnlMsgVerdictBatch MessageType = nfQnlMsgVerdictBatch
+)
+
+// Commands of a ConfigCommand
+const (
+	NfUlnlCfgCmdBind     = nfUlnlCfgCmdBind
+	NfUlnlCfgCmdUnbind   = nfUlnlCfgCmdUnbind
+	NfUlnlCfgCmdPfBind   = nfUlnlCfgCmdPfBind
+	NfUlnlCfgCmdPfUnbind = nfUlnlCfgCmdPfUnbind
+)
+
+// Message is a decoded message of the nfqueue subsystem. Depending on Type,
+// one of Packet, Verdict or Config is set.
+type Message struct {
+	Type MessageType
+	// Family and QueueNum are taken from struct nfgenmsg.
+	Family   uint8
+	QueueNum uint16
+
+	Packet  *Packet
+	Verdict *VerdictMessage
+	Config  *ConfigMessage
+}
+
+// VerdictMessage contains the elements of a verdict message.
+type VerdictMessage struct {
+	ID      uint32
+	Verdict Verdict
+	// Batch applies the verdict to all queued packets up to ID.
+	Batch bool
+	// TargetQueue is the queue, a packet with verdict NfQueue is passed on to.
+	TargetQueue uint16
+	// Bypass accepts a packet with verdict NfQueue, if no program is
+	// listening on TargetQueue.
+	Bypass bool
+
+	Mark     *uint32
+	ConnMark *uint32
+	Label    []byte
+	// Payload is the altered packet.
+	Payload []byte
+	// Expectation is attached to the conntrack entry of the packet.
+	Expectation *Expectation
+}
+
+// ConfigMessage contains the elements of a config message.
+type ConfigMessage struct {
+	Command     *ConfigCommand
+	Params      *ConfigParams
+	QueueMaxLen *uint32
+	Flags       *uint32
+	Mask        *uint32
+}
+
+// ConfigCommand represents struct nfqnl_msg_config_cmd.
+type ConfigCommand struct {
+	Command uint8
+	PF      uint16
+}
+
+// ConfigParams represents struct nfqnl_msg_config_params.
+type ConfigParams struct {
+	CopyRange uint32
+	CopyMode  uint8
+}
+
+func nfqueueHeaderType(t MessageType) netlink.HeaderType {
+	return netlink.HeaderType((nfnlSubSysQueue << 8) | uint16(t))
+}
+
+// /include/uapi/linux/netfilter/nfnetlink.h:struct nfgenmsg{} res_id is Big Endian
+func putExtraHeader(familiy, version uint8, resid uint16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, resid)
+	return append([]byte{familiy, version}, buf...)
+}
+
+func newAttributeEncoder() *netlink.AttributeEncoder {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	return ae
+}
+
+func encodeMessage(t MessageType, family uint8, queue uint16, ae *netlink.AttributeEncoder) (netlink.Message, error) {
+	attrs, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	data := append(putExtraHeader(family, unix.NFNETLINK_V0, queue), attrs...)
+	return netlink.Message{
+		Header: netlink.Header{
+			Length: uint32(nlmsgHeaderLen + len(data)),
+			Type:   nfqueueHeaderType(t),
+		},
+		Data: data,
+	}, nil
+}
+
+// MarshalPacket encodes a as NFQNL_MSG_PACKET message, as it is sent by the
+// kernel. Family and QueueNum of a are used for struct nfgenmsg. Unknown
+// attributes are encoded in ascending order of their type.
+func MarshalPacket(a Attribute) (netlink.Message, error) {
+	ae := newAttributeEncoder()
+	if a.PacketID != nil {
+		hdr := make([]byte, 7)
+		binary.BigEndian.PutUint32(hdr[0:4], *a.PacketID)
+		if a.HwProtocol != nil {
+			binary.BigEndian.PutUint16(hdr[4:6], *a.HwProtocol)
+		}
+		if a.Hook != nil {
+			hdr[6] = byte(*a.Hook)
+		}
+		ae.Bytes(nfQaPacketHdr, hdr)
+	}
+	if a.Mark != nil {
+		ae.Uint32(nfQaMark, *a.Mark)
+	}
+	if a.Timestamp != nil {
+		ts := make([]byte, 16)
+		binary.BigEndian.PutUint64(ts[0:8], uint64(a.Timestamp.Unix()))
+		binary.BigEndian.PutUint64(ts[8:16], uint64(a.Timestamp.Nanosecond()/1000))
+		ae.Bytes(nfQaTimestamp, ts)
+	}
+	putUint32 := func(typ uint16, v *uint32) {
+		if v != nil {
+			ae.Uint32(typ, *v)
+		}
+	}
+	putUint32(nfQaIfIndexInDev, a.InDev)
+	putUint32(nfQaIfIndexOutDev, a.OutDev)
+	putUint32(nfQaIfIndexPhysInDev, a.PhysInDev)
+	putUint32(nfQaIfIndexPhysOutDev, a.PhysOutDev)
+	if a.HwAddr != nil {
+		// struct nfqnl_msg_packet_hw
+		if len(*a.HwAddr) > 8 {
+			return netlink.Message{}, fmt.Errorf("nfQaHwAddr: hwAddrLen %d exceeds 8 bytes", len(*a.HwAddr))
+		}
+		hw := make([]byte, 12)
+		binary.BigEndian.PutUint16(hw[0:2], uint16(len(*a.HwAddr)))
+		copy(hw[4:], *a.HwAddr)
+		ae.Bytes(nfQaHwAddr, hw)
+	}
+	if a.Payload != nil {
+		ae.Bytes(nfQaPayload, *a.Payload)
+	}
+	if a.Ct != nil {
+		ae.Bytes(netlink.Nested|nfQaCt, *a.Ct)
+	}
+	if a.CtInfo != nil {
+		ae.Uint32(nfQaCtInfo, uint32(*a.CtInfo))
+	}
+	putUint32(nfQaCapLen, a.CapLen)
+	if a.SkbInfo != nil {
+		ae.Bytes(nfQaSkbInfo, *a.SkbInfo)
+	}
+	if a.Exp != nil {
+		ae.Bytes(netlink.Nested|nfQaExp, *a.Exp)
+	}
+	putUint32(nfQaUID, a.UID)
+	putUint32(nfQaGID, a.GID)
+	if a.SecCtx != nil {
+		ae.String(nfQaSecCtx, *a.SecCtx)
+	}
+	if a.VLAN != nil {
+		vlan := *a.VLAN
+		ae.Nested(nfQaVLAN, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint16(nfQaVLANProto, vlan.TPID)
+			nae.Uint16(nfQaVLANTCI, vlan.TCI)
+			return nil
+		})
+	}
+	if a.L2Hdr != nil {
+		ae.Bytes(nfQaL2HDR, *a.L2Hdr)
+	}
+	putUint32(nfQaPriority, a.SkbPrio)
+	for _, typ := range slices.Sorted(maps.Keys(a.Unknown)) {
+		ae.Bytes(typ, a.Unknown[typ])
+	}
+
+	var family uint8
+	if a.Family != nil {
+		family = *a.Family
+	}
+	var queue uint16
+	if a.QueueNum != nil {
+		queue = *a.QueueNum
+	}
+	return encodeMessage(NfQnlMsgPacket, family, queue, ae)
+}
+
+// MarshalVerdict encodes v as NFQNL_MSG_VERDICT or NFQNL_MSG_VERDICT_BATCH
+// message for the given family and queue.
+func MarshalVerdict(family uint8, queue uint16, v VerdictMessage) (netlink.Message, error) {
+	/*
+		struct nfqnl_msg_verdict_hdr {
+			__be32 verdict;
+			__be32 id;
+		};
+	*/
+	verdict := uint32(v.Verdict)&nfVerdictMask | uint32(v.TargetQueue)<<nfVerdictQBits
+	if v.Bypass {
+		verdict |= nfVerdictFlagQueueBypass
+	}
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[0:4], verdict)
+	binary.BigEndian.PutUint32(hdr[4:8], v.ID)
+
+	ae := newAttributeEncoder()
+	ae.Bytes(nfQaVerdictHdr, hdr)
+	if v.Mark != nil {
+		ae.Uint32(nfQaMark, *v.Mark)
+	}
+	if v.Payload != nil {
+		ae.Bytes(nfQaPayload, v.Payload)
+	}
+	// The kernel considers NFQA_EXP only together with NFQA_CT.
+	if v.ConnMark != nil || v.Label != nil || v.Expectation != nil {
+		ae.Nested(nfQaCt, func(nae *netlink.AttributeEncoder) error {
+			if v.ConnMark != nil {
+				nae.Uint32(ctaMark, *v.ConnMark)
+			}
+			if v.Label != nil {
+				nae.Bytes(ctaLabels, v.Label)
+			}
+			return nil
+		})
+	}
+	if v.Expectation != nil {
+		ae.Nested(nfQaExp, v.Expectation.encode)
+	}
+
+	t := NfQnlMsgVerdict
+	if v.Batch {
+		t = NfQnlMsgVerdictBatch
+	}
+	return encodeMessage(t, family, queue, ae)
+}
+
+// MarshalConfig encodes c as NFQNL_MSG_CONFIG message for the given family
+// and queue.
+func MarshalConfig(family uint8, queue uint16, c ConfigMessage) (netlink.Message, error) {
+	ae := newAttributeEncoder()
+	if c.Command != nil {
+		cmd := make([]byte, 4)
+		cmd[0] = c.Command.Command
+		binary.BigEndian.PutUint16(cmd[2:4], c.Command.PF)
+		ae.Bytes(nfQaCfgCmd, cmd)
+	}
+	if c.Params != nil {
+		params := make([]byte, 5)
+		binary.BigEndian.PutUint32(params[0:4], c.Params.CopyRange)
+		params[4] = c.Params.CopyMode
+		ae.Bytes(nfQaCfgParams, params)
+	}
+	if c.Flags != nil {
+		ae.Uint32(nfQaCfgFlags, *c.Flags)
+	}
+	if c.Mask != nil {
+		ae.Uint32(nfQaCfgMask, *c.Mask)
+	}
+	if c.QueueMaxLen != nil {
+		ae.Uint32(nfQaCfgQueueMaxLen, *c.QueueMaxLen)
+	}
+	return encodeMessage(NfQnlMsgConfig, family, queue, ae)
+}
+
+// UnmarshalMessage decodes a single raw netlink message of the nfqueue
+// subsystem.
+func UnmarshalMessage(b []byte) (Message, error) {
+	var m netlink.Message
+	if err := m.UnmarshalBinary(b); err != nil {
+		return Message{}, err
+	}
+	return DecodeMessage(m)
+}
+
+// DecodeMessage decodes a netlink message of the nfqueue subsystem.
+func DecodeMessage(m netlink.Message) (Message, error) {
+	var msg Message
+
+	if m.Header.Type>>8 != nfnlSubSysQueue {
+		return msg, fmt.Errorf("subsystem %d: %w", m.Header.Type>>8, ErrUnexpMsg)
+	}
+	msg.Type = MessageType(m.Header.Type & 0xff)
+	if len(m.Data) < 4 {
+		return msg, fmt.Errorf("too less data for header")
+	}
+	msg.Family = m.Data[0]
+	msg.QueueNum = binary.BigEndian.Uint16(m.Data[2:4])
+
+	switch msg.Type {
+	case NfQnlMsgPacket:
+		msg.Packet = new(Packet)
+		return msg, extractPacket(new(devNull), msg.Packet, m.Data, false)
+	case NfQnlMsgVerdict, NfQnlMsgVerdictBatch:
+		msg.Verdict = &VerdictMessage{Batch: msg.Type == NfQnlMsgVerdictBatch}
+		return msg, decodeVerdict(msg.Verdict, m.Data[4:])
+	case NfQnlMsgConfig:
+		msg.Config = new(ConfigMessage)
+		return msg, decodeConfig(msg.Config, m.Data[4:])
+	}
+	return msg, fmt.Errorf("message type %d: %w", msg.Type, ErrUnexpMsg)
+}
+
+func decodeVerdict(v *VerdictMessage, data []byte) error {
+	as := newAttrScanner(data)
+	for as.next() {
+		switch as.typ {
+		case nfQaVerdictHdr:
+			if len(as.data) < 8 {
+				as.err = fmt.Errorf("nfQaVerdictHdr: insufficient data length: %d", len(as.data))
+				continue
+			}
+			verdict := binary.BigEndian.Uint32(as.data[0:4])
+			v.Verdict = Verdict(verdict & nfVerdictMask)
+			v.TargetQueue = uint16(verdict >> nfVerdictQBits)
+			v.Bypass = verdict&nfVerdictFlagQueueBypass != 0
+			v.ID = binary.BigEndian.Uint32(as.data[4:8])
+		case nfQaMark:
+			mark := as.uint32()
+			v.Mark = &mark
+		case nfQaPayload:
+			v.Payload = as.bytes(false)
+		case nfQaCt:
+			ct := newAttrScanner(as.data)
+			for ct.next() {
+				switch ct.typ {
+				case ctaMark:
+					mark := ct.uint32()
+					v.ConnMark = &mark
+				case ctaLabels:
+					v.Label = ct.bytes(false)
+				}
+			}
+			as.err = ct.err
+		case nfQaExp:
+			exp, err := DecodeExpectation(as.data)
+			if err != nil {
+				as.err = err
+				continue
+			}
+			v.Expectation = &exp
+		}
+	}
+	return as.err
+}
+
+func decodeConfig(c *ConfigMessage, data []byte) error {
+	as := newAttrScanner(data)
+	for as.next() {
+		switch as.typ {
+		case nfQaCfgCmd:
+			if len(as.data) < 4 {
+				as.err = fmt.Errorf("nfQaCfgCmd: insufficient data length: %d", len(as.data))
+				continue
+			}
+			c.Command = &ConfigCommand{
+				Command: as.data[0],
+				PF:      binary.BigEndian.Uint16(as.data[2:4]),
+			}
+		case nfQaCfgParams:
+			if len(as.data) < 5 {
+				as.err = fmt.Errorf("nfQaCfgParams: insufficient data length: %d", len(as.data))
+				continue
+			}
+			c.Params = &ConfigParams{
+				CopyRange: binary.BigEndian.Uint32(as.data[0:4]),
+				CopyMode:  as.data[4],
+			}
+		case nfQaCfgQueueMaxLen:
+			maxLen := as.uint32()
+			c.QueueMaxLen = &maxLen
+		case nfQaCfgFlags:
+			flags := as.uint32()
+			c.Flags = &flags
+		case nfQaCfgMask:
+			mask := as.uint32()
+			c.Mask = &mask
+		}
+	}
+	return as.err
+}
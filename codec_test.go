@@ -0,0 +1,297 @@
+package nfqueue
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+func TestMarshalPacket(t *testing.T) {
+	id := uint32(42)
+	hook := HookForward
+	ts := time.Unix(1700000000, 123000)
+	mark := uint32(7)
+	payload := []byte{0x45, 0x00, 0x00, 0x14}
+	hwAddr := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	hwProto := uint16(0x0800)
+	vlan := VLAN{TPID: 0x8100, TCI: 0x002a}
+	family := uint8(2)
+	queue := uint16(100)
+
+	m, err := MarshalPacket(Attribute{
+		PacketID:   &id,
+		Hook:       &hook,
+		Timestamp:  &ts,
+		Mark:       &mark,
+		Payload:    &payload,
+		HwAddr:     &hwAddr,
+		HwProtocol: &hwProto,
+		VLAN:       &vlan,
+		Family:     &family,
+		QueueNum:   &queue,
+		Unknown:    map[uint16][]byte{0x30: {0xca, 0xfe}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Type != NfQnlMsgPacket || msg.Family != family || msg.QueueNum != queue || msg.Packet == nil {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	p := msg.Packet
+	if p.PacketID != id || p.Hook != hook || p.Mark != mark || p.HwProtocol != hwProto {
+		t.Errorf("unexpected packet header or mark: %+v", p)
+	}
+	if !p.Timestamp.Equal(ts) {
+		t.Errorf("unexpected timestamp: %v", p.Timestamp)
+	}
+	if !bytes.Equal(p.Payload, payload) || !bytes.Equal(p.HwAddr, hwAddr) {
+		t.Errorf("unexpected payload or hardware address: %v, %v", p.Payload, p.HwAddr)
+	}
+	if p.VLAN != vlan {
+		t.Errorf("unexpected VLAN: %+v", p.VLAN)
+	}
+	if !bytes.Equal(p.Unknown[0x30], []byte{0xca, 0xfe}) {
+		t.Errorf("unexpected unknown attributes: %v", p.Unknown)
+	}
+	if p.Has(FieldUID) {
+		t.Errorf("unexpected UID: %d", p.UID)
+	}
+}
+
+func TestMarshalPacketUnknown(t *testing.T) {
+	unknown := map[uint16][]byte{0x33: {0x03}, 0x30: {0x00}, 0x32: {0x02}, 0x31: {0x01}}
+	want, err := MarshalPacket(Attribute{Unknown: unknown})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for range 10 {
+		m, err := MarshalPacket(Attribute{Unknown: maps.Clone(unknown)})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(m.Data, want.Data) {
+			t.Fatalf("unexpected encoding:\n got %x\nwant %x", m.Data, want.Data)
+		}
+	}
+
+	ad, err := netlink.NewAttributeDecoder(want.Data[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []uint16
+	for ad.Next() {
+		types = append(types, ad.Type())
+	}
+	if !slices.Equal(types, []uint16{0x30, 0x31, 0x32, 0x33}) {
+		t.Errorf("unexpected order of attributes: %v", types)
+	}
+}
+
+func TestMarshalPacketHwAddr(t *testing.T) {
+	tests := map[string]struct {
+		hwAddr net.HardwareAddr
+		err    bool
+	}{
+		"empty":    {hwAddr: net.HardwareAddr{}},
+		"ethernet": {hwAddr: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		"8 bytes":  {hwAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8}},
+		"too long": {hwAddr: make(net.HardwareAddr, 20), err: true},
+	}
+
+	family := uint8(2)
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := MarshalPacket(Attribute{HwAddr: &tc.hwAddr, Family: &family})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			msg, err := DecodeMessage(m)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(msg.Packet.HwAddr, tc.hwAddr) {
+				t.Errorf("unexpected hardware address: %v", msg.Packet.HwAddr)
+			}
+		})
+	}
+}
+
+func TestMarshalVerdict(t *testing.T) {
+	mark := uint32(1)
+	connMark := uint32(2)
+	label := bytes.Repeat([]byte{0x01}, 16)
+
+	for _, batch := range []bool{false, true} {
+		m, err := MarshalVerdict(10, 100, VerdictMessage{
+			ID:       42,
+			Verdict:  NfAccept,
+			Batch:    batch,
+			Mark:     &mark,
+			ConnMark: &connMark,
+			Label:    label,
+			Payload:  []byte{0x60},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		msg, err := DecodeMessage(m)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		v := msg.Verdict
+		if v == nil || msg.Family != 10 || msg.QueueNum != 100 {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+		if v.ID != 42 || v.Verdict != NfAccept || v.Batch != batch {
+			t.Errorf("unexpected verdict: %+v", v)
+		}
+		if v.Mark == nil || *v.Mark != mark || v.ConnMark == nil || *v.ConnMark != connMark {
+			t.Errorf("unexpected marks: %v, %v", v.Mark, v.ConnMark)
+		}
+		if !bytes.Equal(v.Label, label) || !bytes.Equal(v.Payload, []byte{0x60}) {
+			t.Errorf("unexpected label or payload: %v, %v", v.Label, v.Payload)
+		}
+	}
+}
+
+func TestMarshalVerdictTargetQueue(t *testing.T) {
+	vo := &verdictOptions{msg: VerdictMessage{ID: 42, Verdict: NfQueue}}
+	if err := WithTargetQueue(0x1234, true)(vo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := MarshalVerdict(2, 100, vo.msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// struct nfqnl_msg_verdict_hdr
+	if !bytes.Contains(m.Data, []byte{0x12, 0x34, 0x80, 0x03, 0x00, 0x00, 0x00, 0x2a}) {
+		t.Errorf("unexpected encoding of verdict: %x", m.Data)
+	}
+	msg, err := DecodeMessage(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := msg.Verdict; v.Verdict != NfQueue || v.TargetQueue != 0x1234 || !v.Bypass {
+		t.Errorf("unexpected verdict: %+v", v)
+	}
+
+	vo = &verdictOptions{msg: VerdictMessage{ID: 42, Verdict: NfAccept}}
+	if err := WithTargetQueue(1, false)(vo); !errors.Is(err, ErrInvalidVerdict) {
+		t.Errorf("unexpected error for verdict NfAccept: %v", err)
+	}
+}
+
+func TestMarshalVerdictExpectation(t *testing.T) {
+	client := netip.MustParseAddr("2001:db8::1")
+	server := netip.MustParseAddr("2001:db8::2")
+	exp := Expectation{
+		Tuple:   &ConntrackTuple{Src: server, Dst: client, Protocol: 6, DstPort: 50000},
+		Mask:    &ConntrackTuple{Src: netip.IPv6Unspecified(), Dst: netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), Protocol: 6, DstPort: 0xffff},
+		Timeout: 300,
+		Helper:  "ftp",
+		Flags:   ExpectFlagPermanent,
+	}
+
+	vo := &verdictOptions{msg: VerdictMessage{ID: 42, Verdict: NfAccept}}
+	if err := WithExpectation(exp)(vo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := MarshalVerdict(10, 100, vo.msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg, err := DecodeMessage(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := msg.Verdict.Expectation
+	if got == nil {
+		t.Fatalf("missing expectation: %+v", msg.Verdict)
+	}
+	if *got.Tuple != *exp.Tuple || *got.Mask != *exp.Mask {
+		t.Errorf("unexpected tuples: %+v, %+v", got.Tuple, got.Mask)
+	}
+	if got.Timeout != 300 || got.Helper != "ftp" || got.Flags != ExpectFlagPermanent {
+		t.Errorf("unexpected expectation: %+v", got)
+	}
+
+	for name, exp := range map[string]Expectation{
+		"no mask":      {Tuple: exp.Tuple},
+		"mixed family": {Tuple: &ConntrackTuple{Src: client, Dst: netip.MustParseAddr("192.0.2.1")}, Mask: exp.Mask},
+	} {
+		if _, err := MarshalVerdict(10, 100, VerdictMessage{ID: 42, Expectation: &exp}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMarshalConfig(t *testing.T) {
+	flags := uint32(NfQaCfgFlagGSO)
+	maxLen := uint32(2048)
+
+	m, err := MarshalConfig(0, 100, ConfigMessage{
+		Command:     &ConfigCommand{Command: NfUlnlCfgCmdBind, PF: 2},
+		Params:      &ConfigParams{CopyRange: 0xffff, CopyMode: NfQnlCopyPacket},
+		QueueMaxLen: &maxLen,
+		Flags:       &flags,
+		Mask:        &flags,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Contains(m.Data, []byte{NfUlnlCfgCmdBind, 0x00, 0x00, 0x02}) {
+		t.Errorf("unexpected encoding of command: %x", m.Data)
+	}
+	msg, err := DecodeMessage(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := msg.Config
+	if c == nil || msg.Type != NfQnlMsgConfig {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	if c.Command == nil || *c.Command != (ConfigCommand{Command: NfUlnlCfgCmdBind, PF: 2}) {
+		t.Errorf("unexpected command: %+v", c.Command)
+	}
+	if c.Params == nil || *c.Params != (ConfigParams{CopyRange: 0xffff, CopyMode: NfQnlCopyPacket}) {
+		t.Errorf("unexpected params: %+v", c.Params)
+	}
+	if c.QueueMaxLen == nil || *c.QueueMaxLen != maxLen {
+		t.Errorf("unexpected queue length: %v", c.QueueMaxLen)
+	}
+	if c.Flags == nil || *c.Flags != flags || c.Mask == nil || *c.Mask != flags {
+		t.Errorf("unexpected flags or mask: %v, %v", c.Flags, c.Mask)
+	}
+}
+
+func TestDecodeMessageUnexpected(t *testing.T) {
+	_, err := DecodeMessage(netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(0x0400)},
+		Data:   []byte{0x02, 0x00, 0x00, 0x00},
+	})
+	if !errors.Is(err, ErrUnexpMsg) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
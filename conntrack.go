@@ -0,0 +1,420 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Conntrack contains the conntrack entry of a queued packet. The kernel
+// attaches it as Attribute.Ct if the queue is configured with
+// NfQaCfgFlagConntrack.
+type Conntrack struct {
+	// Origin is the tuple of the original direction.
+	Origin *ConntrackTuple
+	// Reply is the tuple of the reply direction.
+	Reply *ConntrackTuple
+	// Master is the original tuple of the master connection, if this
+	// connection was created from an expectation.
+	Master *ConntrackTuple
+
+	Status    ConntrackStatus
+	Mark      uint32
+	Zone      uint16
+	ID        uint32
+	Use       uint32
+	Labels    []byte
+	Helper    string
+	SecCtx    string
+	ProtoInfo *ConntrackProtoInfo
+
+	// Timeout is the remaining lifetime of the entry in seconds.
+	Timeout uint32
+}
+
+// ConntrackTuple describes one direction of a conntrack entry.
+type ConntrackTuple struct {
+	Src      netip.Addr
+	Dst      netip.Addr
+	Protocol uint8
+	SrcPort  uint16
+	DstPort  uint16
+	IcmpID   uint16
+	IcmpType uint8
+	IcmpCode uint8
+	Zone     uint16
+}
+
+// ConntrackProtoInfo contains protocol specific state of a conntrack entry.
+type ConntrackProtoInfo struct {
+	TCP  *ConntrackTCPInfo
+	DCCP *ConntrackDCCPInfo
+	SCTP *ConntrackSCTPInfo
+}
+
+// ConntrackTCPInfo contains the TCP state of a conntrack entry.
+type ConntrackTCPInfo struct {
+	State       TCPState
+	WScaleOrig  uint8
+	WScaleReply uint8
+	// FlagsOrig and FlagsReply hold struct nf_ct_tcp_flags, i.e. the
+	// flags in the high byte and the mask in the low byte.
+	FlagsOrig  uint16
+	FlagsReply uint16
+}
+
+// ConntrackDCCPInfo contains the DCCP state of a conntrack entry.
+type ConntrackDCCPInfo struct {
+	State uint8
+	Role  uint8
+}
+
+// ConntrackSCTPInfo contains the SCTP state of a conntrack entry.
+type ConntrackSCTPInfo struct {
+	State        uint8
+	VTagOriginal uint32
+	VTagReply    uint32
+}
+
+// CtInfo describes the relation of a packet to its conntrack entry
+// (enum ip_conntrack_info).
+type CtInfo uint32
+
+// Values of CtInfo
+// include/uapi/linux/netfilter/nf_conntrack_common.h
+const (
+	// CtEstablished is set for packets of an established connection in
+	// original direction.
+	CtEstablished CtInfo = iota
+	// CtRelated is set for packets of a related connection, e.g. ICMP errors
+	// or expected connections, in original direction.
+	CtRelated
+	// CtNew is set for packets that start a new connection.
+	CtNew
+	// CtEstablishedReply is set for packets of an established connection in
+	// reply direction.
+	CtEstablishedReply
+	// CtRelatedReply is set for packets of a related connection in reply
+	// direction.
+	CtRelatedReply
+)
+
+var ctInfoNames = [...]string{
+	CtEstablished:      "ESTABLISHED",
+	CtRelated:          "RELATED",
+	CtNew:              "NEW",
+	CtEstablishedReply: "ESTABLISHED_REPLY",
+	CtRelatedReply:     "RELATED_REPLY",
+}
+
+// String returns the name of the conntrack info.
+func (c CtInfo) String() string {
+	if c < CtInfo(len(ctInfoNames)) {
+		return ctInfoNames[c]
+	}
+	return fmt.Sprintf("CtInfo(%d)", uint32(c))
+}
+
+// IsReply reports whether the packet travels in reply direction.
+func (c CtInfo) IsReply() bool {
+	return c == CtEstablishedReply || c == CtRelatedReply
+}
+
+// IsNew reports whether the packet starts a new connection.
+func (c CtInfo) IsNew() bool {
+	return c == CtNew
+}
+
+// IsEstablished reports whether the packet belongs to an established connection.
+func (c CtInfo) IsEstablished() bool {
+	return c == CtEstablished || c == CtEstablishedReply
+}
+
+// IsRelated reports whether the packet belongs to a related connection.
+func (c CtInfo) IsRelated() bool {
+	return c == CtRelated || c == CtRelatedReply
+}
+
+// ConntrackStatus holds the status bits of a conntrack entry.
+type ConntrackStatus uint32
+
+// Status bits of a conntrack entry
+// include/uapi/linux/netfilter/nf_conntrack_common.h
+const (
+	CtStatusExpected ConntrackStatus = 1 << iota
+	CtStatusSeenReply
+	CtStatusAssured
+	CtStatusConfirmed
+	CtStatusSrcNAT
+	CtStatusDstNAT
+	CtStatusSeqAdjust
+	CtStatusSrcNATDone
+	CtStatusDstNATDone
+	CtStatusDying
+	CtStatusFixedTimeout
+	CtStatusTemplate
+	CtStatusUntracked
+	CtStatusHelper
+	CtStatusOffload
+	CtStatusHWOffload
+)
+
+// TCPState is the state of a TCP connection as tracked by conntrack.
+type TCPState uint8
+
+// TCP conntrack states
+const (
+	TCPStateNone TCPState = iota
+	TCPStateSynSent
+	TCPStateSynRecv
+	TCPStateEstablished
+	TCPStateFinWait
+	TCPStateCloseWait
+	TCPStateLastAck
+	TCPStateTimeWait
+	TCPStateClose
+	TCPStateSynSent2
+)
+
+var tcpStateNames = [...]string{
+	TCPStateNone:        "NONE",
+	TCPStateSynSent:     "SYN_SENT",
+	TCPStateSynRecv:     "SYN_RECV",
+	TCPStateEstablished: "ESTABLISHED",
+	TCPStateFinWait:     "FIN_WAIT",
+	TCPStateCloseWait:   "CLOSE_WAIT",
+	TCPStateLastAck:     "LAST_ACK",
+	TCPStateTimeWait:    "TIME_WAIT",
+	TCPStateClose:       "CLOSE",
+	TCPStateSynSent2:    "SYN_SENT2",
+}
+
+// String returns the conntrack name of the TCP state.
+func (s TCPState) String() string {
+	if int(s) < len(tcpStateNames) {
+		return tcpStateNames[s]
+	}
+	return fmt.Sprintf("TCPState(%d)", uint8(s))
+}
+
+// DecodeConntrack decodes the conntrack information of Attribute.Ct.
+func DecodeConntrack(data []byte) (Conntrack, error) {
+	var ct Conntrack
+
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return ct, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleOrig:
+			ct.Origin = &ConntrackTuple{}
+			ad.Nested(ct.Origin.decode)
+		case ctaTupleReply:
+			ct.Reply = &ConntrackTuple{}
+			ad.Nested(ct.Reply.decode)
+		case ctaTupleMaster:
+			ct.Master = &ConntrackTuple{}
+			ad.Nested(ct.Master.decode)
+		case ctaStatus:
+			ct.Status = ConntrackStatus(ad.Uint32())
+		case ctaProtoInfo:
+			ct.ProtoInfo = &ConntrackProtoInfo{}
+			ad.Nested(ct.ProtoInfo.decode)
+		case ctaHelp:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == ctaHelpName {
+						ct.Helper = nad.String()
+					}
+				}
+				return nad.Err()
+			})
+		case ctaTimeout:
+			ct.Timeout = ad.Uint32()
+		case ctaMark:
+			ct.Mark = ad.Uint32()
+		case ctaUse:
+			ct.Use = ad.Uint32()
+		case ctaID:
+			ct.ID = ad.Uint32()
+		case ctaZone:
+			ct.Zone = ad.Uint16()
+		case ctaSecCtx:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == ctaSecCtxName {
+						ct.SecCtx = nad.String()
+					}
+				}
+				return nad.Err()
+			})
+		case ctaLabels:
+			ct.Labels = ad.Bytes()
+		}
+	}
+	return ct, ad.Err()
+}
+
+func (t *ConntrackTuple) decode(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleIP:
+			ad.Nested(t.decodeIP)
+		case ctaTupleProto:
+			ad.Nested(t.decodeProto)
+		case ctaTupleZone:
+			t.Zone = ad.Uint16()
+		}
+	}
+	return ad.Err()
+}
+
+// encode appends the attributes of t. The kernel requires both addresses and,
+// depending on Protocol, both ports or the ICMP identifier, type and code.
+func (t *ConntrackTuple) encode(ae *netlink.AttributeEncoder) error {
+	switch {
+	case t.Src.Is4() && t.Dst.Is4():
+		ae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(ctaIPv4Src, t.Src.AsSlice())
+			nae.Bytes(ctaIPv4Dst, t.Dst.AsSlice())
+			return nil
+		})
+	case t.Src.Is6() && t.Dst.Is6():
+		ae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(ctaIPv6Src, t.Src.AsSlice())
+			nae.Bytes(ctaIPv6Dst, t.Dst.AsSlice())
+			return nil
+		})
+	default:
+		return fmt.Errorf("conntrack tuple: addresses %v and %v of different families", t.Src, t.Dst)
+	}
+	ae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint8(ctaProtoNum, t.Protocol)
+		switch t.Protocol {
+		case protocolICMP:
+			nae.Uint16(ctaProtoIcmpID, t.IcmpID)
+			nae.Uint8(ctaProtoIcmpType, t.IcmpType)
+			nae.Uint8(ctaProtoIcmpCode, t.IcmpCode)
+		case protocolICMPv6:
+			nae.Uint16(ctaProtoIcmpv6ID, t.IcmpID)
+			nae.Uint8(ctaProtoIcmpv6Type, t.IcmpType)
+			nae.Uint8(ctaProtoIcmpv6Code, t.IcmpCode)
+		default:
+			nae.Uint16(ctaProtoSrcPort, t.SrcPort)
+			nae.Uint16(ctaProtoDstPort, t.DstPort)
+		}
+		return nil
+	})
+	if t.Zone != 0 {
+		ae.Uint16(ctaTupleZone, t.Zone)
+	}
+	return nil
+}
+
+func (t *ConntrackTuple) decodeIP(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaIPv4Src, ctaIPv6Src:
+			ad.Do(decodeAddr(&t.Src))
+		case ctaIPv4Dst, ctaIPv6Dst:
+			ad.Do(decodeAddr(&t.Dst))
+		}
+	}
+	return ad.Err()
+}
+
+func (t *ConntrackTuple) decodeProto(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaProtoNum:
+			t.Protocol = ad.Uint8()
+		case ctaProtoSrcPort:
+			t.SrcPort = ad.Uint16()
+		case ctaProtoDstPort:
+			t.DstPort = ad.Uint16()
+		case ctaProtoIcmpID, ctaProtoIcmpv6ID:
+			t.IcmpID = ad.Uint16()
+		case ctaProtoIcmpType, ctaProtoIcmpv6Type:
+			t.IcmpType = ad.Uint8()
+		case ctaProtoIcmpCode, ctaProtoIcmpv6Code:
+			t.IcmpCode = ad.Uint8()
+		}
+	}
+	return ad.Err()
+}
+
+func (p *ConntrackProtoInfo) decode(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaProtoInfoTCP:
+			p.TCP = &ConntrackTCPInfo{}
+			ad.Nested(p.TCP.decode)
+		case ctaProtoInfoDCCP:
+			p.DCCP = &ConntrackDCCPInfo{}
+			ad.Nested(p.DCCP.decode)
+		case ctaProtoInfoSCTP:
+			p.SCTP = &ConntrackSCTPInfo{}
+			ad.Nested(p.SCTP.decode)
+		}
+	}
+	return ad.Err()
+}
+
+func (i *ConntrackTCPInfo) decode(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaProtoInfoTCPState:
+			i.State = TCPState(ad.Uint8())
+		case ctaProtoInfoTCPWScaleOrig:
+			i.WScaleOrig = ad.Uint8()
+		case ctaProtoInfoTCPWScaleReply:
+			i.WScaleReply = ad.Uint8()
+		case ctaProtoInfoTCPFlagsOrig:
+			i.FlagsOrig = ad.Uint16()
+		case ctaProtoInfoTCPFlagsReply:
+			i.FlagsReply = ad.Uint16()
+		}
+	}
+	return ad.Err()
+}
+
+func (i *ConntrackDCCPInfo) decode(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaProtoInfoDCCPState:
+			i.State = ad.Uint8()
+		case ctaProtoInfoDCCPRole:
+			i.Role = ad.Uint8()
+		}
+	}
+	return ad.Err()
+}
+
+func (i *ConntrackSCTPInfo) decode(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaProtoInfoSCTPState:
+			i.State = ad.Uint8()
+		case ctaProtoInfoSCTPVTagOriginal:
+			i.VTagOriginal = ad.Uint32()
+		case ctaProtoInfoSCTPVTagReply:
+			i.VTagReply = ad.Uint32()
+		}
+	}
+	return ad.Err()
+}
+
+func decodeAddr(addr *netip.Addr) func(b []byte) error {
+	return func(b []byte) error {
+		a, ok := netip.AddrFromSlice(b)
+		if !ok {
+			return fmt.Errorf("invalid address length: %d", len(b))
+		}
+		*addr = a
+		return nil
+	}
+}
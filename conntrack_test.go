@@ -0,0 +1,161 @@
+package nfqueue
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func marshalTestTuple(t *testing.T, src, dst netip.Addr, proto uint8, sport, dport uint16) []byte {
+	t.Helper()
+	ae := netlink.NewAttributeEncoder()
+	ae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+		nae.Bytes(ctaIPv4Src, src.AsSlice())
+		nae.Bytes(ctaIPv4Dst, dst.AsSlice())
+		return nil
+	})
+	ae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint8(ctaProtoNum, proto)
+		nae.Bytes(ctaProtoSrcPort, []byte{byte(sport >> 8), byte(sport)})
+		nae.Bytes(ctaProtoDstPort, []byte{byte(dport >> 8), byte(dport)})
+		return nil
+	})
+	data, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCtInfo(t *testing.T) {
+	tests := map[string]struct {
+		info        CtInfo
+		name        string
+		reply       bool
+		new         bool
+		established bool
+		related     bool
+	}{
+		"established":       {info: CtEstablished, name: "ESTABLISHED", established: true},
+		"related":           {info: CtRelated, name: "RELATED", related: true},
+		"new":               {info: CtNew, name: "NEW", new: true},
+		"established reply": {info: CtEstablishedReply, name: "ESTABLISHED_REPLY", reply: true, established: true},
+		"related reply":     {info: CtRelatedReply, name: "RELATED_REPLY", reply: true, related: true},
+		"out of range":      {info: 0x80000000, name: "CtInfo(2147483648)"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if s := tc.info.String(); s != tc.name {
+				t.Errorf("unexpected name: %s", s)
+			}
+			if tc.info.IsReply() != tc.reply || tc.info.IsNew() != tc.new {
+				t.Errorf("unexpected IsReply %t or IsNew %t", tc.info.IsReply(), tc.info.IsNew())
+			}
+			if tc.info.IsEstablished() != tc.established || tc.info.IsRelated() != tc.related {
+				t.Errorf("unexpected IsEstablished %t or IsRelated %t", tc.info.IsEstablished(), tc.info.IsRelated())
+			}
+		})
+	}
+}
+
+func TestDecodeConntrack(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	server := netip.MustParseAddr("198.51.100.1")
+
+	tcpInfo, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: ctaProtoInfoTCPState, Data: []byte{byte(TCPStateEstablished)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoInfo, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: netlink.Nested | ctaProtoInfoTCP, Data: tcpInfo},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: netlink.Nested | ctaTupleOrig, Data: marshalTestTuple(t, client, server, 6, 40000, 443)},
+		{Type: netlink.Nested | ctaTupleReply, Data: marshalTestTuple(t, server, client, 6, 443, 40000)},
+		{Type: ctaStatus, Data: []byte{0x00, 0x00, 0x00, 0x0e}},
+		{Type: ctaMark, Data: []byte{0x00, 0x00, 0x00, 0x2a}},
+		{Type: ctaZone, Data: []byte{0x00, 0x07}},
+		{Type: netlink.Nested | ctaProtoInfo, Data: protoInfo},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := DecodeConntrack(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ct.Origin == nil || ct.Origin.Src != client || ct.Origin.Dst != server ||
+		ct.Origin.Protocol != 6 || ct.Origin.SrcPort != 40000 || ct.Origin.DstPort != 443 {
+		t.Errorf("unexpected origin tuple: %+v", ct.Origin)
+	}
+	if ct.Reply == nil || ct.Reply.Src != server || ct.Reply.DstPort != 40000 {
+		t.Errorf("unexpected reply tuple: %+v", ct.Reply)
+	}
+	if ct.Master != nil {
+		t.Errorf("unexpected master tuple: %+v", ct.Master)
+	}
+	if ct.Status != CtStatusSeenReply|CtStatusAssured|CtStatusConfirmed {
+		t.Errorf("unexpected status: %#x", ct.Status)
+	}
+	if ct.Mark != 42 {
+		t.Errorf("unexpected mark: %d", ct.Mark)
+	}
+	if ct.Zone != 7 {
+		t.Errorf("unexpected zone: %d", ct.Zone)
+	}
+	if ct.ProtoInfo == nil || ct.ProtoInfo.TCP == nil || ct.ProtoInfo.TCP.State != TCPStateEstablished {
+		t.Errorf("unexpected proto info: %+v", ct.ProtoInfo)
+	}
+
+	if _, err := DecodeConntrack([]byte{0x05, 0x00}); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+func TestDecodeExpectation(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	server := netip.MustParseAddr("198.51.100.1")
+
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: netlink.Nested | ctaExpectMaster, Data: marshalTestTuple(t, client, server, 6, 40000, 21)},
+		{Type: netlink.Nested | ctaExpectTuple, Data: marshalTestTuple(t, client, server, 6, 0, 50000)},
+		{Type: ctaExpectTimeout, Data: []byte{0x00, 0x00, 0x01, 0x2c}},
+		{Type: ctaExpectHelpName, Data: []byte("ftp\x00")},
+		{Type: ctaExpectFlags, Data: []byte{0x00, 0x00, 0x00, 0x04}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := DecodeExpectation(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp.Master == nil || exp.Master.DstPort != 21 {
+		t.Errorf("unexpected master tuple: %+v", exp.Master)
+	}
+	if exp.Tuple == nil || exp.Tuple.Dst != server || exp.Tuple.DstPort != 50000 {
+		t.Errorf("unexpected expected tuple: %+v", exp.Tuple)
+	}
+	if exp.Mask != nil || exp.NAT != nil {
+		t.Errorf("unexpected mask or NAT: %+v, %+v", exp.Mask, exp.NAT)
+	}
+	if exp.Timeout != 300 {
+		t.Errorf("unexpected timeout: %d", exp.Timeout)
+	}
+	if exp.Helper != "ftp" {
+		t.Errorf("unexpected helper: %q", exp.Helper)
+	}
+	if exp.Flags != ExpectFlagUserspace {
+		t.Errorf("unexpected flags: %#x", exp.Flags)
+	}
+}
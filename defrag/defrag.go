@@ -0,0 +1,529 @@
+package defrag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/florianl/go-nfqueue/v2/header"
+)
+
+// Default limits of a Reassembler.
+const (
+	DefaultTimeout      = 30 * time.Second
+	DefaultMaxBytes     = 4 << 20
+	DefaultMaxDatagrams = 1024
+	DefaultMaxFragments = 64
+)
+
+// maxDatagramLen is the maximum size of a reassembled IP payload.
+const maxDatagramLen = 0xffff
+
+// Various errors
+var (
+	ErrTruncated = errors.New("fragment is truncated")
+	ErrClosed    = errors.New("reassembler is closed")
+)
+
+// Verdicter signals the kernel the verdict for a queued packet.
+// *nfqueue.Nfqueue and *nfqueue.Batcher implement Verdicter.
+type Verdicter interface {
+	SetPacketVerdict(id uint32, verdict nfqueue.Verdict, options ...nfqueue.VerdictOption) error
+}
+
+// PolicyFunc returns the verdict for a complete datagram. For fragmented
+// datagrams, datagram is the reassembled datagram and the verdict applies to
+// every fragment of it. p contains the decoded headers of datagram.
+type PolicyFunc func(datagram []byte, p header.Packet) nfqueue.Verdict
+
+// Config contains options for a Reassembler.
+type Config struct {
+	// Timeout after which the fragments of an incomplete datagram are
+	// discarded. If not set, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Maximum number of bytes held for incomplete datagrams. The oldest
+	// incomplete datagrams are discarded to stay within this limit.
+	// If not set, DefaultMaxBytes is used.
+	MaxBytes int
+
+	// Maximum number of incomplete datagrams. If not set,
+	// DefaultMaxDatagrams is used.
+	MaxDatagrams int
+
+	// Maximum number of fragments of a single datagram. If not set,
+	// DefaultMaxFragments is used.
+	MaxFragments int
+
+	// DiscardVerdict is applied to all fragments of a datagram, that is
+	// discarded because it timed out, exceeded a limit, had overlapping
+	// fragments or could not be decoded. The default is nfqueue.NfDrop.
+	DiscardVerdict nfqueue.Verdict
+
+	// ErrorFunc receives errors that happen while setting verdicts for
+	// discarded datagrams and errors of reassembled datagrams, that could
+	// not be decoded. Optional.
+	ErrorFunc func(err error)
+}
+
+// Reassembler reassembles fragmented datagrams and holds the verdicts for
+// their fragments until the datagram is complete.
+type Reassembler struct {
+	v      Verdicter
+	policy PolicyFunc
+	config Config
+
+	mu        sync.Mutex
+	datagrams map[fragKey]*datagram
+	bytes     int
+	closed    bool
+}
+
+// fragKey identifies the fragments of a datagram.
+type fragKey struct {
+	src      netip.Addr
+	dst      netip.Addr
+	id       uint32
+	protocol uint8
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+func (f *fragment) end() int {
+	return f.offset + len(f.data)
+}
+
+type datagram struct {
+	key     fragKey
+	created time.Time
+	timer   *time.Timer
+
+	ids   []uint32
+	frags []fragment
+	bytes int
+	// total length of the fragmentable part, -1 until the last
+	// fragment was received.
+	total int
+
+	// unfragmentable part of the first fragment
+	first []byte
+	// IPv6 only: offset of the next header field pointing to the fragment
+	// header and the protocol following the fragment header.
+	nextHeaderOffset int
+	nextHeader       uint8
+}
+
+// New returns a Reassembler that sets the verdicts for packets via v and
+// decides on the verdicts of complete datagrams with policy.
+func New(v Verdicter, policy PolicyFunc, config Config) *Reassembler {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultMaxBytes
+	}
+	if config.MaxDatagrams <= 0 {
+		config.MaxDatagrams = DefaultMaxDatagrams
+	}
+	if config.MaxFragments <= 0 {
+		config.MaxFragments = DefaultMaxFragments
+	}
+	return &Reassembler{
+		v:         v,
+		policy:    policy,
+		config:    config,
+		datagrams: make(map[fragKey]*datagram),
+	}
+}
+
+// Handle processes the queued packet id with the given payload and family,
+// as reported by the netfilter queue. Packets that are not fragmented are
+// passed to the policy right away. Fragments are held until their datagram
+// is complete.
+//
+// If Handle returns an error, no verdict was set for the packet. If the
+// datagram of the packet is discarded, Handle sets Config.DiscardVerdict
+// for all of its fragments and returns no error.
+func (r *Reassembler) Handle(id uint32, payload []byte, family uint8) error {
+	p, err := header.Decode(payload, family)
+	if err != nil && !(p.IsFragment() && errors.Is(err, header.ErrTruncated)) {
+		// A first fragment might not carry the complete transport header.
+		return err
+	}
+	if !p.IsFragment() || isAtomicFragment(&p) {
+		return r.v.SetPacketVerdict(id, r.policy(payload, p))
+	}
+
+	f, key, err := r.newFragment(payload, &p)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	d, discarded := r.add(id, key, f, payload, &p)
+	var b []byte
+	if d != nil {
+		b = d.reassemble()
+	}
+	r.mu.Unlock()
+
+	r.discard(discarded)
+	if d == nil {
+		return nil
+	}
+
+	dp, err := header.Decode(b, family)
+	if err != nil && !errors.Is(err, header.ErrTruncated) {
+		// The verdict for this packet is set as part of the datagram.
+		r.discard([]*datagram{d})
+		if r.config.ErrorFunc != nil {
+			r.config.ErrorFunc(fmt.Errorf("reassembled datagram: %w", err))
+		}
+		return nil
+	}
+	return r.setVerdict(d.ids, r.policy(b, dp))
+}
+
+// Close discards all incomplete datagrams.
+func (r *Reassembler) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	var discarded []*datagram
+	for _, d := range r.datagrams {
+		discarded = append(discarded, r.remove(d))
+	}
+	r.mu.Unlock()
+
+	return r.discardErr(discarded)
+}
+
+// isAtomicFragment reports whether p is an IPv6 fragment, that contains the
+// complete datagram (RFC 6946).
+func isAtomicFragment(p *header.Packet) bool {
+	return p.Version == 6 && p.IPv6Fragment.FragOff == 0 && !p.IPv6Fragment.MoreFragments
+}
+
+// newFragment extracts the fragmentable part of payload.
+func (r *Reassembler) newFragment(payload []byte, p *header.Packet) (fragment, fragKey, error) {
+	var f fragment
+	var key fragKey
+
+	switch p.Version {
+	case 4:
+		end := int(p.IPv4.TotalLen)
+		if len(payload) < end {
+			return f, key, ErrTruncated
+		}
+		if end < p.IPv4.HeaderLen() {
+			return f, key, fmt.Errorf("%w: total length %d below header length", header.ErrInvalidHeader, end)
+		}
+		key = fragKey{src: p.IPv4.Src, dst: p.IPv4.Dst, id: uint32(p.IPv4.ID), protocol: p.IPv4.Protocol}
+		f.offset = p.IPv4.FragmentOffset()
+		f.data = bytes.Clone(payload[p.IPv4.HeaderLen():end])
+	case 6:
+		end := 40 + int(p.IPv6.PayloadLen)
+		if len(payload) < end {
+			return f, key, ErrTruncated
+		}
+		ext, _, err := ipv6FragmentHeader(payload)
+		if err != nil {
+			return f, key, err
+		}
+		if end < ext.Offset+len(ext.Data) {
+			return f, key, fmt.Errorf("%w: payload length %d below extension headers", header.ErrInvalidHeader, p.IPv6.PayloadLen)
+		}
+		key = fragKey{src: p.IPv6.Src, dst: p.IPv6.Dst, id: p.IPv6Fragment.ID}
+		f.offset = p.IPv6Fragment.FragmentOffset()
+		f.data = bytes.Clone(payload[ext.Offset+len(ext.Data) : end])
+	}
+	return f, key, nil
+}
+
+// add adds the fragment f of packet id to its datagram. It returns the
+// datagram, if it is complete, and all datagrams, that got discarded.
+func (r *Reassembler) add(id uint32, key fragKey, f fragment, payload []byte, p *header.Packet) (*datagram, []*datagram) {
+	var discarded []*datagram
+
+	d, ok := r.datagrams[key]
+	if !ok {
+		if len(r.datagrams) >= r.config.MaxDatagrams {
+			discarded = append(discarded, r.remove(r.oldest()))
+		}
+		d = &datagram{key: key, created: time.Now(), total: -1}
+		d.timer = time.AfterFunc(r.config.Timeout, func() { r.expire(d) })
+		r.datagrams[key] = d
+	}
+	d.ids = append(d.ids, id)
+
+	last := !isMoreFragments(p)
+	if !d.valid(f, last) || len(d.frags) >= r.config.MaxFragments {
+		return nil, append(discarded, r.remove(d))
+	}
+	if d.isDuplicate(f) {
+		return nil, discarded
+	}
+	if f.offset == 0 {
+		if err := d.setFirst(payload, p); err != nil {
+			return nil, append(discarded, r.remove(d))
+		}
+	}
+	if last {
+		d.total = f.end()
+	}
+	d.insert(f)
+	d.bytes += len(f.data)
+	r.bytes += len(f.data)
+
+	for r.bytes > r.config.MaxBytes {
+		o := r.oldest()
+		discarded = append(discarded, r.remove(o))
+		if o == d {
+			return nil, discarded
+		}
+	}
+
+	if !d.complete() {
+		return nil, discarded
+	}
+	r.remove(d)
+	if d.oversized() {
+		return nil, append(discarded, d)
+	}
+	return d, discarded
+}
+
+func isMoreFragments(p *header.Packet) bool {
+	if p.Version == 6 {
+		return p.IPv6Fragment.MoreFragments
+	}
+	return p.IPv4.MoreFragments()
+}
+
+// oldest returns the oldest incomplete datagram.
+func (r *Reassembler) oldest() *datagram {
+	var oldest *datagram
+	for _, d := range r.datagrams {
+		if oldest == nil || d.created.Before(oldest.created) {
+			oldest = d
+		}
+	}
+	return oldest
+}
+
+// remove removes d from the incomplete datagrams.
+func (r *Reassembler) remove(d *datagram) *datagram {
+	if cur, ok := r.datagrams[d.key]; ok && cur == d {
+		delete(r.datagrams, d.key)
+		r.bytes -= d.bytes
+		d.timer.Stop()
+	}
+	return d
+}
+
+func (r *Reassembler) expire(d *datagram) {
+	r.mu.Lock()
+	if cur, ok := r.datagrams[d.key]; !ok || cur != d {
+		r.mu.Unlock()
+		return
+	}
+	r.remove(d)
+	r.mu.Unlock()
+
+	r.discard([]*datagram{d})
+}
+
+// discard applies the discard verdict to all fragments of the given datagrams
+// and reports errors to Config.ErrorFunc.
+func (r *Reassembler) discard(datagrams []*datagram) {
+	if err := r.discardErr(datagrams); err != nil && r.config.ErrorFunc != nil {
+		r.config.ErrorFunc(err)
+	}
+}
+
+func (r *Reassembler) discardErr(datagrams []*datagram) error {
+	var errs []error
+	for _, d := range datagrams {
+		if err := r.setVerdict(d.ids, r.config.DiscardVerdict); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Reassembler) setVerdict(ids []uint32, verdict nfqueue.Verdict) error {
+	var errs []error
+	for _, id := range ids {
+		if err := r.v.SetPacketVerdict(id, verdict); err != nil {
+			errs = append(errs, fmt.Errorf("could not set verdict for packet %d: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// valid reports whether f can be part of d.
+func (d *datagram) valid(f fragment, last bool) bool {
+	if len(f.data) == 0 || f.end() > maxDatagramLen {
+		return false
+	}
+	// All fragments but the last one carry a multiple of 8 bytes.
+	if !last && len(f.data)%8 != 0 {
+		return false
+	}
+	if last && d.total >= 0 && d.total != f.end() {
+		return false
+	}
+	if !last && d.total >= 0 && f.end() >= d.total {
+		return false
+	}
+	if last {
+		for _, o := range d.frags {
+			if o.end() > f.end() {
+				return false
+			}
+		}
+	}
+	// Overlapping fragments are not accepted (RFC 5722), except for
+	// exact duplicates.
+	for _, o := range d.frags {
+		if f.offset < o.end() && o.offset < f.end() {
+			if o.offset != f.offset || !bytes.Equal(o.data, f.data) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (d *datagram) isDuplicate(f fragment) bool {
+	for _, o := range d.frags {
+		if o.offset == f.offset {
+			return true
+		}
+	}
+	return false
+}
+
+// insert adds f to the fragments of d, which are ordered by offset.
+func (d *datagram) insert(f fragment) {
+	i := len(d.frags)
+	for i > 0 && d.frags[i-1].offset > f.offset {
+		i--
+	}
+	d.frags = append(d.frags, fragment{})
+	copy(d.frags[i+1:], d.frags[i:])
+	d.frags[i] = f
+}
+
+// setFirst remembers the unfragmentable part of the first fragment.
+func (d *datagram) setFirst(payload []byte, p *header.Packet) error {
+	switch p.Version {
+	case 4:
+		d.first = bytes.Clone(payload[:p.IPv4.HeaderLen()])
+	case 6:
+		ext, nextHeaderOffset, err := ipv6FragmentHeader(payload)
+		if err != nil {
+			return err
+		}
+		d.first = bytes.Clone(payload[:ext.Offset])
+		d.nextHeaderOffset = nextHeaderOffset
+		d.nextHeader = ext.NextHeader
+	}
+	return nil
+}
+
+// ipv6FragmentHeader returns the fragment header of payload and the offset of
+// the next header field, that points to it.
+func ipv6FragmentHeader(payload []byte) (header.IPv6Extension, int, error) {
+	w, err := header.NewIPv6ExtensionWalker(payload)
+	if err != nil {
+		return header.IPv6Extension{}, 0, err
+	}
+	// offset of the next header field of the IPv6 header
+	nextHeaderOffset := 6
+	for w.Next() {
+		ext := w.Header()
+		if ext.Protocol == header.ProtocolFragment {
+			return ext, nextHeaderOffset, nil
+		}
+		nextHeaderOffset = ext.Offset
+	}
+	if err := w.Err(); err != nil {
+		return header.IPv6Extension{}, 0, err
+	}
+	return header.IPv6Extension{}, 0, errors.New("IPv6 fragment header not found")
+}
+
+// complete reports whether all fragments of d were received.
+func (d *datagram) complete() bool {
+	if d.total < 0 || d.first == nil {
+		return false
+	}
+	next := 0
+	for _, f := range d.frags {
+		if f.offset != next {
+			return false
+		}
+		next = f.end()
+	}
+	return next == d.total
+}
+
+// oversized reports whether the reassembled datagram exceeds the length
+// field of its IP header.
+func (d *datagram) oversized() bool {
+	if d.first[0]>>4 == 4 {
+		return len(d.first)+d.total > maxDatagramLen
+	}
+	return len(d.first)-40+d.total > maxDatagramLen
+}
+
+// reassemble returns the reassembled datagram.
+func (d *datagram) reassemble() []byte {
+	b := make([]byte, 0, len(d.first)+d.total)
+	b = append(b, d.first...)
+	for _, f := range d.frags {
+		b = append(b, f.data...)
+	}
+
+	if b[0]>>4 == 4 {
+		hlen := len(d.first)
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+		// Clear the MF flag and the fragment offset, but keep DF.
+		b[6] &= 0x40
+		b[7] = 0
+		b[10], b[11] = 0, 0
+		binary.BigEndian.PutUint16(b[10:12], checksum(b[:hlen]))
+		return b
+	}
+
+	b[d.nextHeaderOffset] = d.nextHeader
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)-40))
+	return b
+}
+
+// checksum returns the internet checksum (RFC 1071) of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
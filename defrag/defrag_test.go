@@ -0,0 +1,338 @@
+package defrag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/florianl/go-nfqueue/v2/header"
+)
+
+type testVerdicter struct {
+	mu       sync.Mutex
+	verdicts map[uint32]nfqueue.Verdict
+}
+
+func (v *testVerdicter) SetPacketVerdict(id uint32, verdict nfqueue.Verdict, _ ...nfqueue.VerdictOption) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.verdicts == nil {
+		v.verdicts = make(map[uint32]nfqueue.Verdict)
+	}
+	v.verdicts[id] = verdict
+	return nil
+}
+
+var (
+	_ Verdicter = (*nfqueue.Nfqueue)(nil)
+	_ Verdicter = (*nfqueue.Batcher)(nil)
+)
+
+func (v *testVerdicter) get(id uint32) (nfqueue.Verdict, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	verdict, ok := v.verdicts[id]
+	return verdict, ok
+}
+
+// testIPv4UDP returns an IPv4 UDP datagram with n bytes of payload.
+func testIPv4UDP(n int) []byte {
+	b := []byte{
+		// IPv4
+		0x45, 0x00, 0x00, 0x00, 0x12, 0x34, 0x00, 0x00,
+		0x40, 0x11, 0x00, 0x00, 0xc0, 0x00, 0x02, 0x01,
+		0xc6, 0x33, 0x64, 0x01,
+		// UDP
+		0xd4, 0x31, 0x00, 0x35, 0x00, 0x00, 0x00, 0x00,
+	}
+	for i := range n {
+		b = append(b, byte(i))
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[24:26], uint16(len(b)-20))
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:20]))
+	return b
+}
+
+// fragmentIPv4 splits datagram into fragments of at most size bytes of data.
+func fragmentIPv4(datagram []byte, size int) [][]byte {
+	var frags [][]byte
+	data := datagram[20:]
+	for off := 0; off < len(data); off += size {
+		end := min(off+size, len(data))
+		f := append(bytes.Clone(datagram[:20]), data[off:end]...)
+		binary.BigEndian.PutUint16(f[2:4], uint16(len(f)))
+		flags := uint16(off / 8)
+		if end < len(data) {
+			flags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(f[6:8], flags)
+		f[10], f[11] = 0, 0
+		binary.BigEndian.PutUint16(f[10:12], checksum(f[:20]))
+		frags = append(frags, f)
+	}
+	return frags
+}
+
+// testIPv6UDP returns an IPv6 UDP datagram with a destination options header
+// and n bytes of payload.
+func testIPv6UDP(n int) []byte {
+	b := []byte{
+		// IPv6
+		0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x3c, 0x40,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		// destination options
+		0x11, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00,
+		// UDP
+		0xd4, 0x31, 0x00, 0x35, 0x00, 0x00, 0x00, 0x00,
+	}
+	for i := range n {
+		b = append(b, byte(i))
+	}
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)-40))
+	binary.BigEndian.PutUint16(b[52:54], uint16(len(b)-48))
+	return b
+}
+
+// fragmentIPv6 splits datagram after the IPv6 header into fragments of at most
+// size bytes of data.
+func fragmentIPv6(datagram []byte, id uint32, size int) [][]byte {
+	var frags [][]byte
+	data := datagram[40:]
+	for off := 0; off < len(data); off += size {
+		end := min(off+size, len(data))
+		f := bytes.Clone(datagram[:40])
+		f[6] = header.ProtocolFragment
+		fh := make([]byte, 8)
+		fh[0] = datagram[6]
+		flags := uint16(off)
+		if end < len(data) {
+			flags |= 1
+		}
+		binary.BigEndian.PutUint16(fh[2:4], flags)
+		binary.BigEndian.PutUint32(fh[4:8], id)
+		f = append(f, fh...)
+		f = append(f, data[off:end]...)
+		binary.BigEndian.PutUint16(f[4:6], uint16(len(f)-40))
+		frags = append(frags, f)
+	}
+	return frags
+}
+
+func TestReassemble(t *testing.T) {
+	ipv4 := testIPv4UDP(100)
+	ipv6 := testIPv6UDP(100)
+
+	tests := map[string]struct {
+		datagram []byte
+		family   uint8
+		frags    [][]byte
+	}{
+		"ipv4":          {datagram: ipv4, family: header.FamilyIPv4, frags: fragmentIPv4(ipv4, 32)},
+		"ipv4 tiny":     {datagram: ipv4, family: header.FamilyIPv4, frags: fragmentIPv4(ipv4, 8)},
+		"ipv6":          {datagram: ipv6, family: header.FamilyIPv6, frags: fragmentIPv6(ipv6, 42, 48)},
+		"ipv6 reversed": {datagram: ipv6, family: header.FamilyIPv6, frags: reversed(fragmentIPv6(ipv6, 42, 24))},
+		"ipv4 reversed": {datagram: ipv4, family: header.FamilyIPv4, frags: reversed(fragmentIPv4(ipv4, 16))},
+		"ipv4 single":   {datagram: ipv4, family: header.FamilyIPv4, frags: [][]byte{ipv4}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := new(testVerdicter)
+			var got []byte
+			var calls int
+			r := New(v, func(datagram []byte, p header.Packet) nfqueue.Verdict {
+				calls++
+				got = datagram
+				if p.DstPort() != 53 {
+					t.Errorf("unexpected destination port: %d", p.DstPort())
+				}
+				return nfqueue.NfAccept
+			}, Config{DiscardVerdict: nfqueue.NfDrop})
+			defer r.Close()
+
+			for i, f := range tc.frags {
+				if err := r.Handle(uint32(i), f, tc.family); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if calls != 1 {
+				t.Fatalf("policy called %d times", calls)
+			}
+			if !bytes.Equal(got, tc.datagram) {
+				t.Errorf("unexpected datagram:\n got %x\nwant %x", got, tc.datagram)
+			}
+			for i := range tc.frags {
+				if verdict, ok := v.get(uint32(i)); !ok || verdict != nfqueue.NfAccept {
+					t.Errorf("unexpected verdict for fragment %d: %d, %t", i, verdict, ok)
+				}
+			}
+		})
+	}
+}
+
+func reversed(frags [][]byte) [][]byte {
+	slices.Reverse(frags)
+	return frags
+}
+
+func TestReassembleDiscard(t *testing.T) {
+	ipv4 := testIPv4UDP(100)
+	frags := fragmentIPv4(ipv4, 32)
+	overlap := fragmentIPv4(ipv4, 24)[1]
+	// TCP header with a data offset of 4 bytes
+	invalid := bytes.Clone(ipv4)
+	invalid[9], invalid[32] = header.ProtocolTCP, 0x10
+
+	tests := map[string]struct {
+		config   Config
+		frags    [][]byte
+		reported bool
+	}{
+		"invalid datagram": {
+			// The first fragment does not carry the data offset.
+			frags:    fragmentIPv4(invalid, 8),
+			reported: true,
+		},
+		"overlap": {
+			frags: [][]byte{frags[0], overlap},
+		},
+		"max fragments": {
+			config: Config{MaxFragments: 1},
+			frags:  [][]byte{frags[0], frags[1]},
+		},
+		"max bytes": {
+			config: Config{MaxBytes: 40},
+			frags:  [][]byte{frags[0], frags[1]},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := new(testVerdicter)
+			var reported bool
+			tc.config.ErrorFunc = func(error) { reported = true }
+			r := New(v, func([]byte, header.Packet) nfqueue.Verdict {
+				t.Error("unexpected call of policy")
+				return nfqueue.NfAccept
+			}, tc.config)
+			defer r.Close()
+
+			for i, f := range tc.frags {
+				if err := r.Handle(uint32(i), f, header.FamilyIPv4); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if reported != tc.reported {
+				t.Errorf("unexpected report of error: %t", reported)
+			}
+			for i := range tc.frags {
+				if verdict, ok := v.get(uint32(i)); !ok || verdict != nfqueue.NfDrop {
+					t.Errorf("unexpected verdict for fragment %d: %d, %t", i, verdict, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestReassembleInvalidLength(t *testing.T) {
+	ipv4 := fragmentIPv4(testIPv4UDP(100), 32)[1]
+	// total length below the header length
+	binary.BigEndian.PutUint16(ipv4[2:4], 10)
+	ipv6 := fragmentIPv6(testIPv6UDP(100), 42, 48)[1]
+	// payload length below the fragment header
+	binary.BigEndian.PutUint16(ipv6[4:6], 4)
+
+	tests := map[string]struct {
+		payload []byte
+		family  uint8
+	}{
+		"ipv4": {payload: ipv4, family: header.FamilyIPv4},
+		"ipv6": {payload: ipv6, family: header.FamilyIPv6},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := new(testVerdicter)
+			r := New(v, func([]byte, header.Packet) nfqueue.Verdict {
+				t.Error("unexpected call of policy")
+				return nfqueue.NfAccept
+			}, Config{})
+			defer r.Close()
+
+			if err := r.Handle(1, tc.payload, tc.family); !errors.Is(err, header.ErrInvalidHeader) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, ok := v.get(1); ok {
+				t.Error("unexpected verdict")
+			}
+		})
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	v := new(testVerdicter)
+	errs := make(chan error, 1)
+	r := New(v, func([]byte, header.Packet) nfqueue.Verdict {
+		t.Error("unexpected call of policy")
+		return nfqueue.NfAccept
+	}, Config{Timeout: 10 * time.Millisecond, ErrorFunc: func(err error) { errs <- err }})
+	defer r.Close()
+
+	frags := fragmentIPv4(testIPv4UDP(100), 32)
+	if err := r.Handle(1, frags[0], header.FamilyIPv4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := v.get(1); ok {
+		t.Fatal("verdict set for incomplete datagram")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if verdict, ok := v.get(1); ok {
+			if verdict != nfqueue.NfDrop {
+				t.Errorf("unexpected verdict: %d", verdict)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("incomplete datagram did not time out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestReassembleMaxDatagrams(t *testing.T) {
+	v := new(testVerdicter)
+	r := New(v, func([]byte, header.Packet) nfqueue.Verdict { return nfqueue.NfAccept }, Config{MaxDatagrams: 1})
+	defer r.Close()
+
+	first := fragmentIPv4(testIPv4UDP(100), 32)
+	second := testIPv4UDP(100)
+	second[5]++ // different IP ID
+	if err := r.Handle(1, first[0], header.FamilyIPv4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Handle(2, fragmentIPv4(second, 32)[0], header.FamilyIPv4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if verdict, ok := v.get(1); !ok || verdict != nfqueue.NfDrop {
+		t.Errorf("oldest datagram not discarded: %d, %t", verdict, ok)
+	}
+	if _, ok := v.get(2); ok {
+		t.Error("verdict set for incomplete datagram")
+	}
+}
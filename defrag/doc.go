@@ -0,0 +1,11 @@
+/*
+Package defrag reassembles fragmented IPv4 and IPv6 datagrams received from a
+netfilter queue.
+
+Each fragment of a datagram is queued to userspace as a separate packet and only
+the first fragment carries the transport header. A Reassembler holds the verdict
+for all fragments of a datagram until the datagram is complete, passes the
+reassembled datagram to a policy and applies the verdict of the policy to every
+fragment.
+*/
+package defrag
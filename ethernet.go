@@ -0,0 +1,71 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// EtherTypes of VLAN tags
+const (
+	etherTypeVLAN    = 0x8100 // 802.1Q
+	etherTypeQinQ    = 0x88a8 // 802.1ad
+	etherTypeQinQOld = 0x9100 // pre-standard 802.1ad
+)
+
+const (
+	ethernetHeaderLen = 14
+	vlanTagLen        = 4
+)
+
+// EthernetHeader is the decoded Ethernet header of a packet.
+type EthernetHeader struct {
+	Dst net.HardwareAddr
+	Src net.HardwareAddr
+	// VLANs contains the 802.1Q/802.1ad tags of the header, outermost first.
+	VLANs []VLAN
+	// EtherType is the type of the payload following the header and all
+	// of its VLAN tags.
+	EtherType uint16
+}
+
+// Len returns the length of the header in bytes including all VLAN tags.
+func (h EthernetHeader) Len() int {
+	return ethernetHeaderLen + len(h.VLANs)*vlanTagLen
+}
+
+// DecodeEthernetHeader decodes the Ethernet header of Attribute.L2Hdr.
+// The returned hardware addresses share the underlying memory with data.
+func DecodeEthernetHeader(data []byte) (EthernetHeader, error) {
+	var h EthernetHeader
+
+	if len(data) < ethernetHeaderLen {
+		return h, fmt.Errorf("ethernet header: insufficient data length: %d", len(data))
+	}
+	h.Dst = net.HardwareAddr(data[0:6])
+	h.Src = net.HardwareAddr(data[6:12])
+	h.EtherType = binary.BigEndian.Uint16(data[12:14])
+
+	offset := ethernetHeaderLen
+	for isVLANEtherType(h.EtherType) {
+		if len(data) < offset+vlanTagLen {
+			return h, fmt.Errorf("ethernet header: insufficient data for VLAN tag %d: got %d",
+				len(h.VLANs), len(data))
+		}
+		h.VLANs = append(h.VLANs, VLAN{
+			TPID: h.EtherType,
+			TCI:  binary.BigEndian.Uint16(data[offset : offset+2]),
+		})
+		h.EtherType = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+		offset += vlanTagLen
+	}
+	return h, nil
+}
+
+func isVLANEtherType(etherType uint16) bool {
+	switch etherType {
+	case etherTypeVLAN, etherTypeQinQ, etherTypeQinQOld:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package nfqueue
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeEthernetHeader(t *testing.T) {
+	dst := []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	src := []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	addrs := append(append([]byte{}, dst...), src...)
+
+	tests := map[string]struct {
+		data      []byte
+		etherType uint16
+		vlans     []VLAN
+		wantErr   bool
+	}{
+		"untagged": {
+			data:      append(append([]byte{}, addrs...), 0x08, 0x00),
+			etherType: 0x0800,
+		},
+		"802.1Q": {
+			data:      append(append([]byte{}, addrs...), 0x81, 0x00, 0x00, 0x2a, 0x86, 0xdd),
+			etherType: 0x86dd,
+			vlans:     []VLAN{{TPID: 0x8100, TCI: 42}},
+		},
+		"802.1ad": {
+			data: append(append([]byte{}, addrs...),
+				0x88, 0xa8, 0x00, 0x64, 0x81, 0x00, 0x00, 0x2a, 0x08, 0x00),
+			etherType: 0x0800,
+			vlans:     []VLAN{{TPID: 0x88a8, TCI: 100}, {TPID: 0x8100, TCI: 42}},
+		},
+		"truncated header": {
+			data:    addrs,
+			wantErr: true,
+		},
+		"truncated tag": {
+			data:    append(append([]byte{}, addrs...), 0x81, 0x00, 0x00, 0x2a),
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			h, err := DecodeEthernetHeader(tc.data)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected error")
+			}
+			if !bytes.Equal(h.Dst, dst) || !bytes.Equal(h.Src, src) {
+				t.Errorf("unexpected addresses: %v -> %v", h.Src, h.Dst)
+			}
+			if h.EtherType != tc.etherType {
+				t.Errorf("unexpected EtherType: %#x", h.EtherType)
+			}
+			if len(h.VLANs) != len(tc.vlans) {
+				t.Fatalf("unexpected VLANs: %v", h.VLANs)
+			}
+			for i := range h.VLANs {
+				if h.VLANs[i] != tc.vlans[i] {
+					t.Errorf("unexpected VLAN %d: %v", i, h.VLANs[i])
+				}
+			}
+			if h.Len() != len(tc.data) {
+				t.Errorf("unexpected header length: %d", h.Len())
+			}
+		})
+	}
+}
@@ -45,7 +45,7 @@ func ExampleNfqueue_RegisterWithErrorFunc() {
 		id := *a.PacketID
 		// Just print out the id and payload of the nfqueue packet
 		fmt.Printf("[%d]\t%v\n", id, *a.Payload)
-		nf.SetVerdict(id, nfqueue.NfAccept)
+		nf.SetPacketVerdict(id, nfqueue.NfAccept)
 		return 0
 	}
 
@@ -62,3 +62,50 @@ func ExampleNfqueue_RegisterWithErrorFunc() {
 	// Block till the context expires
 	<-ctx.Done()
 }
+
+func ExampleNfqueue_RegisterPacketFunc() {
+	// Send outgoing pings to nfqueue queue 100
+	// # sudo iptables -I OUTPUT -p icmp -j NFQUEUE --queue-num 100
+
+	// Set configuration options for nfqueue
+	config := nfqueue.Config{
+		NfQueue:      100,
+		MaxPacketLen: 0xFFFF,
+		MaxQueueLen:  0xFF,
+		Copymode:     nfqueue.NfQnlCopyPacket,
+		WriteTimeout: 15 * time.Millisecond,
+		// The Packet passed to the callback is only valid until the callback returns.
+		ZeroCopy: true,
+	}
+
+	nf, err := nfqueue.Open(&config)
+	if err != nil {
+		fmt.Println("could not open nfqueue socket:", err)
+		return
+	}
+	defer nf.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fn := func(p *nfqueue.Packet) int {
+		if p.Has(nfqueue.FieldMark) {
+			fmt.Printf("[%d]\tmark: %d\n", p.PacketID, p.Mark)
+		}
+		nf.SetPacketVerdict(p.PacketID, nfqueue.NfAccept)
+		return 0
+	}
+
+	// Register your function to listen on nfqueue queue 100
+	err = nf.RegisterPacketFunc(ctx, fn, func(e error) int {
+		fmt.Println(e)
+		return -1
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Block till the context expires
+	<-ctx.Done()
+}
@@ -0,0 +1,155 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mdlayher/netlink"
+)
+
+var errExpectationTuple = errors.New("expectation requires Tuple and Mask")
+
+// Expectation contains a conntrack expectation as carried in NFQA_EXP.
+//
+// The kernel does not report expectations with queued packets. It only
+// accepts them in verdicts, see WithExpectation, to attach an expectation to
+// the connection of the packet. Packets of a connection that was created from
+// an expectation carry the tuple of the master connection in Conntrack.Master.
+type Expectation struct {
+	// Master is the original tuple of the connection that created the
+	// expectation. It is ignored in verdicts, as the connection of the
+	// packet is the master.
+	Master *ConntrackTuple
+	// Tuple is the tuple the expected connection has to match.
+	Tuple *ConntrackTuple
+	// Mask selects the parts of Tuple that have to match. Its Protocol has
+	// to be the one of Tuple.
+	Mask *ConntrackTuple
+	// NAT contains the NAT setup for the expected connection, if any.
+	NAT *ExpectationNAT
+
+	// Timeout is the remaining lifetime of the expectation in seconds.
+	// Verdicts require it, unless the connection has a conntrack helper.
+	Timeout uint32
+	// ID is assigned by the kernel and ignored in verdicts.
+	ID     uint32
+	Helper string
+	Zone   uint16
+	Flags  ExpectationFlags
+	Class  uint32
+	// Fn is the name of the expectation function of the helper.
+	Fn string
+}
+
+// ExpectationNAT describes the NAT setup of an expected connection.
+type ExpectationNAT struct {
+	// Dir is the conntrack direction the NAT applies to.
+	Dir   uint32
+	Tuple *ConntrackTuple
+}
+
+// ExpectationFlags holds the flags of a conntrack expectation.
+type ExpectationFlags uint32
+
+// Flags of a conntrack expectation
+// include/uapi/linux/netfilter/nf_conntrack_common.h
+const (
+	ExpectFlagPermanent ExpectationFlags = 1 << iota
+	ExpectFlagInactive
+	ExpectFlagUserspace
+)
+
+// DecodeExpectation decodes the nested attributes of a conntrack expectation,
+// e.g. of a verdict message encoded by MarshalVerdict. The kernel does not
+// set Attribute.Exp for queued packets.
+func DecodeExpectation(data []byte) (Expectation, error) {
+	var exp Expectation
+
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return exp, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaExpectMaster:
+			exp.Master = &ConntrackTuple{}
+			ad.Nested(exp.Master.decode)
+		case ctaExpectTuple:
+			exp.Tuple = &ConntrackTuple{}
+			ad.Nested(exp.Tuple.decode)
+		case ctaExpectMask:
+			exp.Mask = &ConntrackTuple{}
+			ad.Nested(exp.Mask.decode)
+		case ctaExpectTimeout:
+			exp.Timeout = ad.Uint32()
+		case ctaExpectID:
+			exp.ID = ad.Uint32()
+		case ctaExpectHelpName:
+			exp.Helper = ad.String()
+		case ctaExpectZone:
+			exp.Zone = ad.Uint16()
+		case ctaExpectFlags:
+			exp.Flags = ExpectationFlags(ad.Uint32())
+		case ctaExpectClass:
+			exp.Class = ad.Uint32()
+		case ctaExpectNAT:
+			exp.NAT = &ExpectationNAT{}
+			ad.Nested(exp.NAT.decode)
+		case ctaExpectFn:
+			exp.Fn = ad.String()
+		}
+	}
+	return exp, ad.Err()
+}
+
+func (n *ExpectationNAT) decode(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaExpectNATDir:
+			n.Dir = ad.Uint32()
+		case ctaExpectNATTuple:
+			n.Tuple = &ConntrackTuple{}
+			ad.Nested(n.Tuple.decode)
+		}
+	}
+	return ad.Err()
+}
+
+// encode appends the attributes of e, that the kernel accepts in verdicts.
+func (e *Expectation) encode(ae *netlink.AttributeEncoder) error {
+	if e.Tuple == nil || e.Mask == nil {
+		return errExpectationTuple
+	}
+	ae.Nested(ctaExpectTuple, e.Tuple.encode)
+	ae.Nested(ctaExpectMask, e.Mask.encode)
+	if e.Timeout != 0 {
+		ae.Uint32(ctaExpectTimeout, e.Timeout)
+	}
+	if e.Helper != "" {
+		ae.String(ctaExpectHelpName, e.Helper)
+	}
+	if e.Zone != 0 {
+		ae.Uint16(ctaExpectZone, e.Zone)
+	}
+	if e.Flags != 0 {
+		ae.Uint32(ctaExpectFlags, uint32(e.Flags))
+	}
+	if e.Class != 0 {
+		ae.Uint32(ctaExpectClass, e.Class)
+	}
+	if e.NAT != nil {
+		nat := e.NAT
+		ae.Nested(ctaExpectNAT, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint32(ctaExpectNATDir, nat.Dir)
+			if nat.Tuple != nil {
+				nae.Nested(ctaExpectNATTuple, nat.Tuple.encode)
+			}
+			return nil
+		})
+	}
+	if e.Fn != "" {
+		ae.String(ctaExpectFn, e.Fn)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+/*
+Package header decodes the network and transport headers of packets received
+from a netfilter queue.
+
+The package does not depend on anything but the standard library. All types
+returned by it refer to the memory of the decoded payload and do not copy it.
+*/
+package header
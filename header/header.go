@@ -0,0 +1,208 @@
+package header
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Protocol families as reported by the netfilter queue, e.g. Attribute.Family.
+const (
+	FamilyUnspec = 0x0
+	FamilyIPv4   = 0x2
+	FamilyBridge = 0x7
+	FamilyIPv6   = 0xa
+)
+
+// Transport protocol numbers
+const (
+	ProtocolICMP   = 1
+	ProtocolTCP    = 6
+	ProtocolUDP    = 17
+	ProtocolICMPv6 = 58
+)
+
+// Various errors
+var (
+	ErrTruncated     = errors.New("truncated header")
+	ErrInvalidHeader = errors.New("invalid header")
+	ErrNotIP         = errors.New("payload is neither IPv4 nor IPv6")
+)
+
+// Packet contains the decoded headers of a payload received from a netfilter
+// queue. Version selects the valid network header and Protocol the valid
+// transport header.
+type Packet struct {
+	// Version is the IP version of the packet, 4 or 6.
+	Version uint8
+	IPv4    IPv4
+	IPv6    IPv6
+
+	// IPv6Fragment holds the fragment header of fragmented IPv6 packets.
+	// IsFragment reports whether it is present.
+	IPv6Fragment IPv6Fragment
+	ipv6Fragment bool
+
+	// Protocol is the transport protocol of the packet. For IPv6 it is the
+	// protocol following all extension headers.
+	Protocol uint8
+	TCP      TCP
+	UDP      UDP
+	// ICMP holds the ICMP header for ProtocolICMP and the ICMPv6 header for
+	// ProtocolICMPv6.
+	ICMP ICMP
+
+	// TransportOffset is the offset of the transport header in the payload.
+	TransportOffset int
+	// PayloadOffset is the offset of the transport payload in the payload.
+	// It equals TransportOffset, if the transport header was not decoded.
+	PayloadOffset int
+}
+
+// Decode decodes the network and transport headers of payload. family is the
+// protocol family reported by the netfilter queue. For FamilyBridge and
+// FamilyUnspec the IP version is taken from the payload.
+//
+// The transport header is not decoded for unknown transport protocols and for
+// fragments, that do not contain the transport header. If the payload is
+// truncated, e.g. as a result of Config.MaxPacketLen, the headers decoded so
+// far are returned along with ErrTruncated.
+func Decode(payload []byte, family uint8) (Packet, error) {
+	var p Packet
+
+	if len(payload) < 1 {
+		return p, fmt.Errorf("network header: %w", ErrTruncated)
+	}
+	version := payload[0] >> 4
+	switch family {
+	case FamilyIPv4:
+		if version != 4 {
+			return p, fmt.Errorf("IP version %d in IPv4 family: %w", version, ErrInvalidHeader)
+		}
+	case FamilyIPv6:
+		if version != 6 {
+			return p, fmt.Errorf("IP version %d in IPv6 family: %w", version, ErrInvalidHeader)
+		}
+	case FamilyBridge, FamilyUnspec:
+		if version != 4 && version != 6 {
+			return p, ErrNotIP
+		}
+	default:
+		return p, fmt.Errorf("unsupported family %d", family)
+	}
+
+	var err error
+	switch version {
+	case 4:
+		p.Version = 4
+		if p.IPv4, err = DecodeIPv4(payload); err != nil {
+			return p, err
+		}
+		p.Protocol = p.IPv4.Protocol
+		p.TransportOffset = p.IPv4.HeaderLen()
+		if p.IPv4.FragmentOffset() != 0 {
+			p.PayloadOffset = p.TransportOffset
+			return p, nil
+		}
+	case 6:
+		p.Version = 6
+		if p.IPv6, err = DecodeIPv6(payload); err != nil {
+			return p, err
+		}
+		w := newIPv6ExtensionWalker(payload, p.IPv6)
+		for w.Next() {
+		}
+		p.Protocol = w.Protocol()
+		p.TransportOffset = w.Offset()
+		p.PayloadOffset = p.TransportOffset
+		if err := w.Err(); err != nil {
+			return p, err
+		}
+		p.IPv6Fragment, p.ipv6Fragment = w.Fragment()
+		if p.ipv6Fragment && p.IPv6Fragment.FragOff != 0 {
+			return p, nil
+		}
+	}
+
+	return p, p.decodeTransport(payload[p.TransportOffset:])
+}
+
+func (p *Packet) decodeTransport(b []byte) error {
+	var err error
+	p.PayloadOffset = p.TransportOffset
+	switch p.Protocol {
+	case ProtocolTCP:
+		if p.TCP, err = DecodeTCP(b); err != nil {
+			return err
+		}
+		p.PayloadOffset += p.TCP.HeaderLen()
+	case ProtocolUDP:
+		if p.UDP, err = DecodeUDP(b); err != nil {
+			return err
+		}
+		p.PayloadOffset += udpHeaderLen
+	case ProtocolICMP, ProtocolICMPv6:
+		if p.ICMP, err = DecodeICMP(b); err != nil {
+			return err
+		}
+		p.PayloadOffset += icmpHeaderLen
+	}
+	return nil
+}
+
+// Src returns the source address of the packet.
+func (p *Packet) Src() netip.Addr {
+	if p.Version == 6 {
+		return p.IPv6.Src
+	}
+	return p.IPv4.Src
+}
+
+// Dst returns the destination address of the packet.
+func (p *Packet) Dst() netip.Addr {
+	if p.Version == 6 {
+		return p.IPv6.Dst
+	}
+	return p.IPv4.Dst
+}
+
+// SrcPort returns the source port of TCP and UDP packets or 0 otherwise.
+func (p *Packet) SrcPort() uint16 {
+	if !p.hasTransport() {
+		return 0
+	}
+	switch p.Protocol {
+	case ProtocolTCP:
+		return p.TCP.SrcPort
+	case ProtocolUDP:
+		return p.UDP.SrcPort
+	}
+	return 0
+}
+
+// DstPort returns the destination port of TCP and UDP packets or 0 otherwise.
+func (p *Packet) DstPort() uint16 {
+	if !p.hasTransport() {
+		return 0
+	}
+	switch p.Protocol {
+	case ProtocolTCP:
+		return p.TCP.DstPort
+	case ProtocolUDP:
+		return p.UDP.DstPort
+	}
+	return 0
+}
+
+// IsFragment reports whether the packet is a fragment of a larger datagram.
+func (p *Packet) IsFragment() bool {
+	if p.Version == 6 {
+		return p.ipv6Fragment
+	}
+	return p.Version == 4 && p.IPv4.IsFragment()
+}
+
+// hasTransport reports whether the transport header was decoded.
+func (p *Packet) hasTransport() bool {
+	return p.PayloadOffset > p.TransportOffset
+}
@@ -0,0 +1,205 @@
+package header
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func testIPv4TCP() []byte {
+	return []byte{
+		// IPv4
+		0x45, 0x00, 0x00, 0x2c, 0x12, 0x34, 0x40, 0x00,
+		0x40, 0x06, 0x00, 0x00, 0xc0, 0x00, 0x02, 0x01,
+		0xc6, 0x33, 0x64, 0x01,
+		// TCP
+		0x9c, 0x40, 0x01, 0xbb, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x50, 0x02, 0xff, 0xff,
+		0x00, 0x00, 0x00, 0x00,
+		// payload
+		0xde, 0xad, 0xbe, 0xef,
+	}
+}
+
+func testIPv6UDP() []byte {
+	return []byte{
+		// IPv6
+		0x60, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x11, 0x40,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		// UDP
+		0xd4, 0x31, 0x00, 0x35, 0x00, 0x0c, 0x00, 0x00,
+		// payload
+		0xca, 0xfe, 0xca, 0xfe,
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := map[string]struct {
+		payload  []byte
+		family   uint8
+		version  uint8
+		protocol uint8
+		src, dst netip.Addr
+		sport    uint16
+		dport    uint16
+		offset   int
+		err      error
+	}{
+		"ipv4 tcp": {
+			payload:  testIPv4TCP(),
+			family:   FamilyIPv4,
+			version:  4,
+			protocol: ProtocolTCP,
+			src:      netip.MustParseAddr("192.0.2.1"),
+			dst:      netip.MustParseAddr("198.51.100.1"),
+			sport:    40000,
+			dport:    443,
+			offset:   40,
+		},
+		"ipv6 udp": {
+			payload:  testIPv6UDP(),
+			family:   FamilyIPv6,
+			version:  6,
+			protocol: ProtocolUDP,
+			src:      netip.MustParseAddr("2001:db8::1"),
+			dst:      netip.MustParseAddr("2001:db8::2"),
+			sport:    54321,
+			dport:    53,
+			offset:   48,
+		},
+		"bridge": {
+			payload:  testIPv6UDP(),
+			family:   FamilyBridge,
+			version:  6,
+			protocol: ProtocolUDP,
+			src:      netip.MustParseAddr("2001:db8::1"),
+			dst:      netip.MustParseAddr("2001:db8::2"),
+			sport:    54321,
+			dport:    53,
+			offset:   48,
+		},
+		"family mismatch": {
+			payload: testIPv6UDP(),
+			family:  FamilyIPv4,
+			err:     ErrInvalidHeader,
+		},
+		"not ip": {
+			payload: []byte{0x00, 0x01, 0x08, 0x00},
+			family:  FamilyBridge,
+			err:     ErrNotIP,
+		},
+		"truncated": {
+			payload:  testIPv4TCP()[:30],
+			family:   FamilyIPv4,
+			version:  4,
+			protocol: ProtocolTCP,
+			src:      netip.MustParseAddr("192.0.2.1"),
+			dst:      netip.MustParseAddr("198.51.100.1"),
+			offset:   20,
+			err:      ErrTruncated,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := Decode(tc.payload, tc.family)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.Version != tc.version || p.Protocol != tc.protocol {
+				t.Errorf("unexpected version %d or protocol %d", p.Version, p.Protocol)
+			}
+			if tc.version == 0 {
+				return
+			}
+			if p.Src() != tc.src || p.Dst() != tc.dst {
+				t.Errorf("unexpected addresses: %s -> %s", p.Src(), p.Dst())
+			}
+			if p.SrcPort() != tc.sport || p.DstPort() != tc.dport {
+				t.Errorf("unexpected ports: %d -> %d", p.SrcPort(), p.DstPort())
+			}
+			if p.PayloadOffset != tc.offset {
+				t.Errorf("unexpected payload offset: %d", p.PayloadOffset)
+			}
+		})
+	}
+}
+
+func TestDecodeIPv4Fragment(t *testing.T) {
+	payload := testIPv4TCP()
+	// MF flag and fragment offset of 8 bytes
+	payload[6], payload[7] = 0x20, 0x01
+
+	p, err := Decode(payload, FamilyIPv4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !p.IsFragment() || !p.IPv4.MoreFragments() || p.IPv4.FragmentOffset() != 8 {
+		t.Errorf("unexpected fragment information: %+v", p.IPv4)
+	}
+	if p.SrcPort() != 0 || p.PayloadOffset != p.TransportOffset {
+		t.Errorf("transport header of non-first fragment decoded")
+	}
+}
+
+func TestIPv6ExtensionWalker(t *testing.T) {
+	udp := testIPv6UDP()
+	// IPv6 header with hop-by-hop options, destination options and a first
+	// fragment header in front of the UDP header.
+	payload := append([]byte{}, udp[:ipv6HeaderLen]...)
+	payload[6] = ProtocolHopByHop
+	payload = append(payload,
+		ProtocolDstOpts, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00,
+		ProtocolFragment, 0x01, 0x01, 0x0c, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		ProtocolUDP, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x2a,
+	)
+	payload = append(payload, udp[ipv6HeaderLen:]...)
+
+	w, err := NewIPv6ExtensionWalker(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var protocols []uint8
+	for w.Next() {
+		protocols = append(protocols, w.Header().Protocol)
+	}
+	if err := w.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(protocols) != 3 || protocols[0] != ProtocolHopByHop ||
+		protocols[1] != ProtocolDstOpts || protocols[2] != ProtocolFragment {
+		t.Errorf("unexpected extension headers: %v", protocols)
+	}
+	if w.Protocol() != ProtocolUDP || w.Offset() != 72 {
+		t.Errorf("unexpected upper-layer protocol %d at %d", w.Protocol(), w.Offset())
+	}
+	if f, ok := w.Fragment(); !ok || !f.MoreFragments || f.ID != 42 || f.FragmentOffset() != 0 {
+		t.Errorf("unexpected fragment header: %+v", f)
+	}
+
+	p, err := Decode(payload, FamilyIPv6)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Protocol != ProtocolUDP || p.DstPort() != 53 || !p.IsFragment() {
+		t.Errorf("unexpected decoding: %+v", p)
+	}
+
+	// Non-first fragments do not carry the upper-layer header.
+	payload[66], payload[67] = 0x00, 0x11
+	p, err = Decode(payload, FamilyIPv6)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Protocol != ProtocolUDP || p.DstPort() != 0 || p.IPv6Fragment.FragmentOffset() != 16 {
+		t.Errorf("unexpected decoding of non-first fragment: %+v", p)
+	}
+
+	if _, err := Decode(payload[:60], FamilyIPv6); !errors.Is(err, ErrTruncated) {
+		t.Errorf("unexpected error for truncated extension header: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package header
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const icmpHeaderLen = 8
+
+// ICMP is a decoded ICMP or ICMPv6 header.
+type ICMP struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	// Rest holds the type specific remainder of the header, e.g. the
+	// identifier and sequence number of echo messages.
+	Rest uint32
+}
+
+// DecodeICMP decodes the ICMP or ICMPv6 header at the start of b.
+func DecodeICMP(b []byte) (ICMP, error) {
+	var h ICMP
+
+	if len(b) < icmpHeaderLen {
+		return h, fmt.Errorf("ICMP header: %w", ErrTruncated)
+	}
+	h.Type = b[0]
+	h.Code = b[1]
+	h.Checksum = binary.BigEndian.Uint16(b[2:4])
+	h.Rest = binary.BigEndian.Uint32(b[4:8])
+	return h, nil
+}
@@ -0,0 +1,91 @@
+package header
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const ipv4MinHeaderLen = 20
+
+// IPv4 flags
+const (
+	IPv4FlagMoreFragments = 0x1
+	IPv4FlagDontFragment  = 0x2
+)
+
+// IPv4 is a decoded IPv4 header.
+type IPv4 struct {
+	// IHL is the header length in 32-bit words.
+	IHL      uint8
+	TOS      uint8
+	TotalLen uint16
+	ID       uint16
+	// Flags holds the three flag bits of the header.
+	Flags uint8
+	// FragOff is the fragment offset in units of 8 bytes.
+	FragOff  uint16
+	TTL      uint8
+	Protocol uint8
+	Checksum uint16
+	Src      netip.Addr
+	Dst      netip.Addr
+	Options  []byte
+}
+
+// DecodeIPv4 decodes the IPv4 header at the start of b.
+func DecodeIPv4(b []byte) (IPv4, error) {
+	var h IPv4
+
+	if len(b) < ipv4MinHeaderLen {
+		return h, fmt.Errorf("IPv4 header: %w", ErrTruncated)
+	}
+	if version := b[0] >> 4; version != 4 {
+		return h, fmt.Errorf("IPv4 header version %d: %w", version, ErrInvalidHeader)
+	}
+	h.IHL = b[0] & 0x0f
+	if h.HeaderLen() < ipv4MinHeaderLen {
+		return h, fmt.Errorf("IPv4 header length %d: %w", h.HeaderLen(), ErrInvalidHeader)
+	}
+	if len(b) < h.HeaderLen() {
+		return h, fmt.Errorf("IPv4 header options: %w", ErrTruncated)
+	}
+	h.TOS = b[1]
+	h.TotalLen = binary.BigEndian.Uint16(b[2:4])
+	h.ID = binary.BigEndian.Uint16(b[4:6])
+	flagsFrag := binary.BigEndian.Uint16(b[6:8])
+	h.Flags = uint8(flagsFrag >> 13)
+	h.FragOff = flagsFrag & 0x1fff
+	h.TTL = b[8]
+	h.Protocol = b[9]
+	h.Checksum = binary.BigEndian.Uint16(b[10:12])
+	h.Src = netip.AddrFrom4([4]byte(b[12:16]))
+	h.Dst = netip.AddrFrom4([4]byte(b[16:20]))
+	h.Options = b[ipv4MinHeaderLen:h.HeaderLen()]
+	return h, nil
+}
+
+// HeaderLen returns the length of the header in bytes.
+func (h *IPv4) HeaderLen() int {
+	return int(h.IHL) * 4
+}
+
+// MoreFragments reports whether the MF flag is set.
+func (h *IPv4) MoreFragments() bool {
+	return h.Flags&IPv4FlagMoreFragments != 0
+}
+
+// DontFragment reports whether the DF flag is set.
+func (h *IPv4) DontFragment() bool {
+	return h.Flags&IPv4FlagDontFragment != 0
+}
+
+// FragmentOffset returns the offset of the fragment in bytes.
+func (h *IPv4) FragmentOffset() int {
+	return int(h.FragOff) * 8
+}
+
+// IsFragment reports whether the packet is a fragment of a larger datagram.
+func (h *IPv4) IsFragment() bool {
+	return h.MoreFragments() || h.FragOff != 0
+}
@@ -0,0 +1,41 @@
+package header
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const ipv6HeaderLen = 40
+
+// IPv6 is a decoded IPv6 header.
+type IPv6 struct {
+	TrafficClass uint8
+	FlowLabel    uint32
+	PayloadLen   uint16
+	NextHeader   uint8
+	HopLimit     uint8
+	Src          netip.Addr
+	Dst          netip.Addr
+}
+
+// DecodeIPv6 decodes the fixed IPv6 header at the start of b.
+func DecodeIPv6(b []byte) (IPv6, error) {
+	var h IPv6
+
+	if len(b) < ipv6HeaderLen {
+		return h, fmt.Errorf("IPv6 header: %w", ErrTruncated)
+	}
+	if version := b[0] >> 4; version != 6 {
+		return h, fmt.Errorf("IPv6 header version %d: %w", version, ErrInvalidHeader)
+	}
+	first := binary.BigEndian.Uint32(b[0:4])
+	h.TrafficClass = uint8(first >> 20)
+	h.FlowLabel = first & 0x000fffff
+	h.PayloadLen = binary.BigEndian.Uint16(b[4:6])
+	h.NextHeader = b[6]
+	h.HopLimit = b[7]
+	h.Src = netip.AddrFrom16([16]byte(b[8:24]))
+	h.Dst = netip.AddrFrom16([16]byte(b[24:40]))
+	return h, nil
+}
@@ -0,0 +1,190 @@
+package header
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Protocol numbers of IPv6 extension headers
+const (
+	ProtocolHopByHop = 0
+	ProtocolRouting  = 43
+	ProtocolFragment = 44
+	ProtocolESP      = 50
+	ProtocolAH       = 51
+	ProtocolNoNext   = 59
+	ProtocolDstOpts  = 60
+	ProtocolMobility = 135
+	ProtocolHIP      = 139
+	ProtocolShim6    = 140
+)
+
+const ipv6FragmentHeaderLen = 8
+
+// IPv6Extension is an IPv6 extension header.
+type IPv6Extension struct {
+	// Protocol identifies the extension header, e.g. ProtocolRouting.
+	Protocol uint8
+	// NextHeader is the protocol of the header following this one.
+	NextHeader uint8
+	// Offset is the offset of the extension header in the packet.
+	Offset int
+	// Data holds the complete extension header.
+	Data []byte
+}
+
+// IPv6Fragment is a decoded IPv6 fragment header.
+type IPv6Fragment struct {
+	NextHeader uint8
+	// FragOff is the fragment offset in units of 8 bytes.
+	FragOff       uint16
+	MoreFragments bool
+	ID            uint32
+}
+
+// FragmentOffset returns the offset of the fragment in bytes.
+func (f *IPv6Fragment) FragmentOffset() int {
+	return int(f.FragOff) * 8
+}
+
+// DecodeIPv6Fragment decodes the IPv6 fragment header at the start of b.
+func DecodeIPv6Fragment(b []byte) (IPv6Fragment, error) {
+	var f IPv6Fragment
+
+	if len(b) < ipv6FragmentHeaderLen {
+		return f, fmt.Errorf("IPv6 fragment header: %w", ErrTruncated)
+	}
+	f.NextHeader = b[0]
+	offFlags := binary.BigEndian.Uint16(b[2:4])
+	f.FragOff = offFlags >> 3
+	f.MoreFragments = offFlags&0x1 != 0
+	f.ID = binary.BigEndian.Uint32(b[4:8])
+	return f, nil
+}
+
+// IPv6ExtensionWalker follows the chain of extension headers of an IPv6 packet.
+//
+//	w, err := NewIPv6ExtensionWalker(payload)
+//	for w.Next() {
+//		ext := w.Header()
+//	}
+//	if err := w.Err(); err != nil {
+//	}
+//	proto, offset := w.Protocol(), w.Offset()
+type IPv6ExtensionWalker struct {
+	b        []byte
+	protocol uint8
+	offset   int
+	cur      IPv6Extension
+	fragment IPv6Fragment
+	hasFrag  bool
+	done     bool
+	err      error
+}
+
+// NewIPv6ExtensionWalker returns a walker for the extension headers of packet,
+// which has to start with the IPv6 header.
+func NewIPv6ExtensionWalker(packet []byte) (*IPv6ExtensionWalker, error) {
+	h, err := DecodeIPv6(packet)
+	if err != nil {
+		return nil, err
+	}
+	return newIPv6ExtensionWalker(packet, h), nil
+}
+
+func newIPv6ExtensionWalker(packet []byte, h IPv6) *IPv6ExtensionWalker {
+	return &IPv6ExtensionWalker{
+		b:        packet,
+		protocol: h.NextHeader,
+		offset:   ipv6HeaderLen,
+	}
+}
+
+// IsIPv6Extension reports whether protocol identifies an IPv6 extension
+// header, that can be walked.
+func IsIPv6Extension(protocol uint8) bool {
+	switch protocol {
+	case ProtocolHopByHop, ProtocolRouting, ProtocolFragment, ProtocolAH,
+		ProtocolDstOpts, ProtocolMobility, ProtocolHIP, ProtocolShim6:
+		return true
+	}
+	return false
+}
+
+// Next advances to the next extension header. It returns false, once the
+// upper-layer header is reached or an error occurred.
+func (w *IPv6ExtensionWalker) Next() bool {
+	if w.done || w.err != nil || !IsIPv6Extension(w.protocol) {
+		return false
+	}
+
+	b := w.b[w.offset:]
+	if len(b) < 2 {
+		w.err = fmt.Errorf("IPv6 extension header %d: %w", w.protocol, ErrTruncated)
+		return false
+	}
+	var length int
+	switch w.protocol {
+	case ProtocolFragment:
+		length = ipv6FragmentHeaderLen
+	case ProtocolAH:
+		length = (int(b[1]) + 2) * 4
+	default:
+		length = (int(b[1]) + 1) * 8
+	}
+	if len(b) < length {
+		w.err = fmt.Errorf("IPv6 extension header %d: %w", w.protocol, ErrTruncated)
+		return false
+	}
+
+	w.cur = IPv6Extension{
+		Protocol:   w.protocol,
+		NextHeader: b[0],
+		Offset:     w.offset,
+		Data:       b[:length],
+	}
+	if w.protocol == ProtocolFragment {
+		f, err := DecodeIPv6Fragment(b)
+		if err != nil {
+			w.err = err
+			return false
+		}
+		w.fragment = f
+		w.hasFrag = true
+		// Only the first fragment carries the headers following the
+		// fragment header.
+		w.done = f.FragOff != 0
+	}
+	w.protocol = w.cur.NextHeader
+	w.offset += length
+	return true
+}
+
+// Header returns the current extension header.
+func (w *IPv6ExtensionWalker) Header() IPv6Extension {
+	return w.cur
+}
+
+// Err returns the first error encountered by the walker.
+func (w *IPv6ExtensionWalker) Err() error {
+	return w.err
+}
+
+// Protocol returns the protocol of the header following the last extension
+// header walked, e.g. the upper-layer protocol once Next returned false.
+// ESP is reported as upper-layer protocol, as the headers it protects can not
+// be walked.
+func (w *IPv6ExtensionWalker) Protocol() uint8 {
+	return w.protocol
+}
+
+// Offset returns the offset of the header following the last extension
+// header walked.
+func (w *IPv6ExtensionWalker) Offset() int {
+	return w.offset
+}
+
+// Fragment returns the fragment header, if one was walked.
+func (w *IPv6ExtensionWalker) Fragment() (IPv6Fragment, bool) {
+	return w.fragment, w.hasFrag
+}
@@ -0,0 +1,89 @@
+package header
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const tcpMinHeaderLen = 20
+
+// TCPFlags holds the control bits of a TCP header.
+type TCPFlags uint16
+
+// TCP control bits
+const (
+	TCPFlagFIN TCPFlags = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+	TCPFlagNS
+)
+
+var tcpFlagNames = [...]string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR", "NS"}
+
+// String returns the names of the set flags separated by "|".
+func (f TCPFlags) String() string {
+	var names []string
+	for i, name := range tcpFlagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// TCP is a decoded TCP header.
+type TCP struct {
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	// DataOffset is the header length in 32-bit words.
+	DataOffset uint8
+	Flags      TCPFlags
+	Window     uint16
+	Checksum   uint16
+	Urgent     uint16
+	Options    []byte
+}
+
+// DecodeTCP decodes the TCP header at the start of b.
+func DecodeTCP(b []byte) (TCP, error) {
+	var h TCP
+
+	if len(b) < tcpMinHeaderLen {
+		return h, fmt.Errorf("TCP header: %w", ErrTruncated)
+	}
+	h.SrcPort = binary.BigEndian.Uint16(b[0:2])
+	h.DstPort = binary.BigEndian.Uint16(b[2:4])
+	h.Seq = binary.BigEndian.Uint32(b[4:8])
+	h.Ack = binary.BigEndian.Uint32(b[8:12])
+	h.DataOffset = b[12] >> 4
+	h.Flags = TCPFlags(binary.BigEndian.Uint16(b[12:14]) & 0x01ff)
+	h.Window = binary.BigEndian.Uint16(b[14:16])
+	h.Checksum = binary.BigEndian.Uint16(b[16:18])
+	h.Urgent = binary.BigEndian.Uint16(b[18:20])
+	if h.HeaderLen() < tcpMinHeaderLen {
+		return h, fmt.Errorf("TCP header length %d: %w", h.HeaderLen(), ErrInvalidHeader)
+	}
+	if len(b) < h.HeaderLen() {
+		return h, fmt.Errorf("TCP header options: %w", ErrTruncated)
+	}
+	h.Options = b[tcpMinHeaderLen:h.HeaderLen()]
+	return h, nil
+}
+
+// HeaderLen returns the length of the header in bytes.
+func (h *TCP) HeaderLen() int {
+	return int(h.DataOffset) * 4
+}
+
+// Has reports whether all of the given flags are set.
+func (h *TCP) Has(flags TCPFlags) bool {
+	return h.Flags&flags == flags
+}
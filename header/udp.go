@@ -0,0 +1,30 @@
+package header
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const udpHeaderLen = 8
+
+// UDP is a decoded UDP header.
+type UDP struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Length   uint16
+	Checksum uint16
+}
+
+// DecodeUDP decodes the UDP header at the start of b.
+func DecodeUDP(b []byte) (UDP, error) {
+	var h UDP
+
+	if len(b) < udpHeaderLen {
+		return h, fmt.Errorf("UDP header: %w", ErrTruncated)
+	}
+	h.SrcPort = binary.BigEndian.Uint16(b[0:2])
+	h.DstPort = binary.BigEndian.Uint16(b[2:4])
+	h.Length = binary.BigEndian.Uint16(b[4:6])
+	h.Checksum = binary.BigEndian.Uint16(b[6:8])
+	return h, nil
+}
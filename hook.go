@@ -0,0 +1,71 @@
+package nfqueue
+
+import (
+	"fmt"
+
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+)
+
+// Hook is the netfilter hook a packet was queued from.
+type Hook uint8
+
+// Netfilter hooks of the IPv4 and IPv6 family
+// include/uapi/linux/netfilter.h
+const (
+	HookPreRouting Hook = iota
+	HookLocalIn
+	HookForward
+	HookLocalOut
+	HookPostRouting
+)
+
+// Netfilter hooks of the bridge family
+// include/uapi/linux/netfilter_bridge.h
+const (
+	HookBridgePreRouting Hook = iota
+	HookBridgeLocalIn
+	HookBridgeForward
+	HookBridgeLocalOut
+	HookBridgePostRouting
+	HookBridgeBRouting
+)
+
+var hookNames = [...]string{
+	HookPreRouting:  "PREROUTING",
+	HookLocalIn:     "INPUT",
+	HookForward:     "FORWARD",
+	HookLocalOut:    "OUTPUT",
+	HookPostRouting: "POSTROUTING",
+}
+
+var bridgeHookNames = [...]string{
+	HookBridgePreRouting:  "PREROUTING",
+	HookBridgeLocalIn:     "INPUT",
+	HookBridgeForward:     "FORWARD",
+	HookBridgeLocalOut:    "OUTPUT",
+	HookBridgePostRouting: "POSTROUTING",
+	HookBridgeBRouting:    "BROUTING",
+}
+
+// String returns the name of the hook, that is common to all families, or
+// Hook(n) for other values. Use Name() to get the name for a specific family,
+// e.g. BROUTING of the bridge family.
+func (h Hook) String() string {
+	return h.name(hookNames[:])
+}
+
+// Name returns the name of the hook for packets of the given family,
+// e.g. the value of Attribute.Family.
+func (h Hook) Name(family uint8) string {
+	if family == unix.NFPROTO_BRIDGE {
+		return h.name(bridgeHookNames[:])
+	}
+	return h.name(hookNames[:])
+}
+
+func (h Hook) name(names []string) string {
+	if int(h) < len(names) {
+		return names[h]
+	}
+	return fmt.Sprintf("Hook(%d)", uint8(h))
+}
@@ -0,0 +1,49 @@
+package nfqueue
+
+import (
+	"testing"
+
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+)
+
+func TestHookName(t *testing.T) {
+	tests := map[string]struct {
+		hook   Hook
+		family uint8
+		name   string
+	}{
+		"ipv4 prerouting":   {hook: HookPreRouting, family: unix.AF_INET, name: "PREROUTING"},
+		"ipv4 input":        {hook: HookLocalIn, family: unix.AF_INET, name: "INPUT"},
+		"ipv4 forward":      {hook: HookForward, family: unix.AF_INET, name: "FORWARD"},
+		"ipv6 output":       {hook: HookLocalOut, family: unix.AF_INET6, name: "OUTPUT"},
+		"ipv6 postrouting":  {hook: HookPostRouting, family: unix.AF_INET6, name: "POSTROUTING"},
+		"ipv4 brouting":     {hook: HookBridgeBRouting, family: unix.AF_INET, name: "Hook(5)"},
+		"bridge prerouting": {hook: HookBridgePreRouting, family: unix.NFPROTO_BRIDGE, name: "PREROUTING"},
+		"bridge output":     {hook: HookBridgeLocalOut, family: unix.NFPROTO_BRIDGE, name: "OUTPUT"},
+		"bridge brouting":   {hook: HookBridgeBRouting, family: unix.NFPROTO_BRIDGE, name: "BROUTING"},
+		"out of range":      {hook: 255, family: unix.NFPROTO_BRIDGE, name: "Hook(255)"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if n := tc.hook.Name(tc.family); n != tc.name {
+				t.Errorf("unexpected name: %s", n)
+			}
+		})
+	}
+}
+
+func TestHookString(t *testing.T) {
+	tests := map[Hook]string{
+		HookPreRouting:     "PREROUTING",
+		HookPostRouting:    "POSTROUTING",
+		HookBridgeBRouting: "Hook(5)",
+		6:                  "Hook(6)",
+	}
+
+	for hook, name := range tests {
+		if s := hook.String(); s != name {
+			t.Errorf("unexpected name of hook %d: %s", uint8(hook), s)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+/*
+Package iface resolves the interface indices of queued packets, like
+Attribute.InDev or Attribute.OutDev, to interface names and attributes.
+
+A Resolver keeps a cache of the interfaces of a network namespace, which is
+updated through rtnetlink link notifications.
+*/
+package iface
@@ -0,0 +1,329 @@
+package iface
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+
+	"github.com/jsimonetti/rtnetlink/v2"
+	"github.com/mdlayher/netlink"
+)
+
+// missTTL is the time an index, that is unknown to the kernel, is not looked
+// up again.
+const missTTL = time.Second
+
+// maxMisses bounds the number of cached unknown indices.
+const maxMisses = 1024
+
+// Config contains options for a Resolver.
+type Config struct {
+	// Network namespace the Resolver needs to operate in. If set to 0 (default),
+	// no network namespace will be entered.
+	NetNS int
+
+	// ErrorFunc receives errors that happen while receiving link
+	// notifications. The cache is resynchronized after such errors.
+	// Optional.
+	ErrorFunc func(err error)
+}
+
+// Interface contains the attributes of a network interface.
+type Interface struct {
+	Index        uint32
+	Name         string
+	Alias        string
+	HardwareAddr net.HardwareAddr
+	MTU          uint32
+	// Flags contains the device flags, see netdevice(7).
+	Flags uint32
+	// Master is the index of the master device or 0.
+	Master uint32
+	// Kind is the type of a virtual device, e.g. "bridge" or "vlan".
+	Kind      string
+	OperState rtnetlink.OperationalState
+}
+
+// Devices contains the names of the devices of a queued packet. The name of
+// a device is empty, if it was not reported by the kernel or is unknown.
+type Devices struct {
+	In      string
+	Out     string
+	PhysIn  string
+	PhysOut string
+}
+
+// Resolver resolves interface indices to interfaces.
+type Resolver struct {
+	// conn is used to query links and notifies receives link
+	// notifications.
+	conn     *rtnetlink.Conn
+	notifies *rtnetlink.Conn
+	errFunc  func(err error)
+	// getLink looks up a link, that is not cached, in the kernel.
+	getLink func(index uint32) (rtnetlink.LinkMessage, error)
+
+	mu     sync.RWMutex
+	byIdx  map[uint32]Interface
+	byName map[string]uint32
+	// misses contains the expiry of indices, that are unknown to the kernel.
+	misses map[uint32]time.Time
+
+	wg     sync.WaitGroup
+	closed chan struct{}
+}
+
+func newResolver() *Resolver {
+	return &Resolver{
+		byIdx:  make(map[uint32]Interface),
+		byName: make(map[string]uint32),
+		misses: make(map[uint32]time.Time),
+		closed: make(chan struct{}),
+	}
+}
+
+// New returns a Resolver for the network namespace given in config.
+func New(config Config) (*Resolver, error) {
+	r := newResolver()
+	r.errFunc = config.ErrorFunc
+
+	var err error
+	r.notifies, err = rtnetlink.Dial(&netlink.Config{NetNS: config.NetNS, Groups: unix.RTMGRP_LINK})
+	if err != nil {
+		return nil, err
+	}
+	r.conn, err = rtnetlink.Dial(&netlink.Config{NetNS: config.NetNS})
+	if err != nil {
+		r.notifies.Close()
+		return nil, err
+	}
+	r.getLink = r.conn.Link.Get
+
+	// Subscribe to notifications before the initial dump, so no change
+	// gets lost.
+	if err := r.sync(); err != nil {
+		r.conn.Close()
+		r.notifies.Close()
+		return nil, err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.receive()
+	}()
+
+	return r, nil
+}
+
+// Close stops receiving link notifications and closes the connections of r.
+func (r *Resolver) Close() error {
+	close(r.closed)
+	// Interrupt a blocking Receive() call.
+	r.notifies.SetReadDeadline(time.Now().Add(-1 * time.Second))
+	r.wg.Wait()
+	return errors.Join(r.notifies.Close(), r.conn.Close())
+}
+
+// Name returns the name of the interface with the given index.
+func (r *Resolver) Name(index uint32) (string, bool) {
+	ifi, ok := r.Interface(index)
+	return ifi.Name, ok
+}
+
+// Index returns the index of the interface with the given name.
+func (r *Resolver) Index(name string) (uint32, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	index, ok := r.byName[name]
+	return index, ok
+}
+
+// Interface returns the attributes of the interface with the given index.
+// Indices that are not cached are looked up in the kernel. If the kernel
+// does not know an index, it is not looked up again for a second, unless a
+// notification adds it.
+func (r *Resolver) Interface(index uint32) (Interface, bool) {
+	if index == 0 {
+		return Interface{}, false
+	}
+	now := time.Now()
+	r.mu.RLock()
+	ifi, ok := r.byIdx[index]
+	missed := now.Before(r.misses[index])
+	r.mu.RUnlock()
+	if ok || missed || r.getLink == nil {
+		return ifi, ok
+	}
+
+	// The notification for a new interface might not be processed yet.
+	msg, err := r.getLink(index)
+	if err != nil {
+		r.miss(index, now)
+		return Interface{}, false
+	}
+	return r.update(&msg), true
+}
+
+// miss remembers, that index is unknown to the kernel.
+func (r *Resolver) miss(index uint32, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.misses) >= maxMisses {
+		for i, expires := range r.misses {
+			if !now.Before(expires) {
+				delete(r.misses, i)
+			}
+		}
+		if len(r.misses) >= maxMisses {
+			clear(r.misses)
+		}
+	}
+	r.misses[index] = now.Add(missTTL)
+}
+
+// Devices returns the names of the devices of a queued packet.
+func (r *Resolver) Devices(a nfqueue.Attribute) Devices {
+	var d Devices
+	name := func(index *uint32) string {
+		if index == nil {
+			return ""
+		}
+		name, _ := r.Name(*index)
+		return name
+	}
+	d.In = name(a.InDev)
+	d.Out = name(a.OutDev)
+	d.PhysIn = name(a.PhysInDev)
+	d.PhysOut = name(a.PhysOutDev)
+	return d
+}
+
+// sync replaces the cache with the current interfaces.
+func (r *Resolver) sync() error {
+	msgs, err := r.conn.Link.List()
+	if err != nil {
+		return err
+	}
+	r.replace(msgs)
+	return nil
+}
+
+// replace swaps the cache for the interfaces of msgs.
+func (r *Resolver) replace(msgs []rtnetlink.LinkMessage) {
+	byIdx := make(map[uint32]Interface, len(msgs))
+	byName := make(map[string]uint32, len(msgs))
+	for i := range msgs {
+		ifi := newInterface(&msgs[i])
+		byIdx[ifi.Index] = ifi
+		byName[ifi.Name] = ifi.Index
+	}
+
+	r.mu.Lock()
+	r.byIdx = byIdx
+	r.byName = byName
+	clear(r.misses)
+	r.mu.Unlock()
+}
+
+func (r *Resolver) receive() {
+	for {
+		rtmsgs, msgs, err := r.notifies.Receive()
+		select {
+		case <-r.closed:
+			return
+		default:
+		}
+		if err != nil {
+			if r.errFunc != nil {
+				r.errFunc(err)
+			}
+			// Notifications might have been lost, e.g. due to an
+			// overrun of the receive buffer.
+			if err := r.sync(); err != nil && r.errFunc != nil {
+				r.errFunc(err)
+			}
+			continue
+		}
+		r.handle(rtmsgs, msgs)
+	}
+}
+
+// handle applies link notifications to the cache.
+func (r *Resolver) handle(rtmsgs []rtnetlink.Message, msgs []netlink.Message) {
+	for i, m := range rtmsgs {
+		link, ok := m.(*rtnetlink.LinkMessage)
+		// Notifications of other families, like AF_BRIDGE for bridge
+		// ports, do not describe the interface itself.
+		if !ok || link.Family != unix.AF_UNSPEC {
+			continue
+		}
+		switch msgs[i].Header.Type {
+		case unix.RTM_NEWLINK:
+			r.update(link)
+		case unix.RTM_DELLINK:
+			r.remove(link.Index)
+		}
+	}
+}
+
+// newInterface returns the attributes of msg.
+func newInterface(msg *rtnetlink.LinkMessage) Interface {
+	ifi := Interface{
+		Index: msg.Index,
+		Flags: msg.Flags,
+	}
+	if a := msg.Attributes; a != nil {
+		ifi.Name = a.Name
+		ifi.HardwareAddr = a.Address
+		ifi.MTU = a.MTU
+		ifi.OperState = a.OperationalState
+		if a.Alias != nil {
+			ifi.Alias = *a.Alias
+		}
+		if a.Master != nil {
+			ifi.Master = *a.Master
+		}
+		if a.Info != nil {
+			ifi.Kind = a.Info.Kind
+		}
+	}
+	return ifi
+}
+
+// update stores the attributes of msg in the cache.
+func (r *Resolver) update(msg *rtnetlink.LinkMessage) Interface {
+	ifi := newInterface(msg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.byIdx[ifi.Index]; ok && old.Name != ifi.Name {
+		r.deleteName(old)
+	}
+	r.byIdx[ifi.Index] = ifi
+	r.byName[ifi.Name] = ifi.Index
+	delete(r.misses, ifi.Index)
+	return ifi
+}
+
+// remove deletes the interface with the given index from the cache.
+func (r *Resolver) remove(index uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.byIdx[index]; ok {
+		r.deleteName(old)
+		delete(r.byIdx, index)
+	}
+}
+
+// deleteName removes the name of ifi, unless it was taken over by another
+// interface.
+func (r *Resolver) deleteName(ifi Interface) {
+	if r.byName[ifi.Name] == ifi.Index {
+		delete(r.byName, ifi.Name)
+	}
+}
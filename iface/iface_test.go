@@ -0,0 +1,140 @@
+package iface
+
+import (
+	"errors"
+	"testing"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+
+	"github.com/jsimonetti/rtnetlink/v2"
+	"github.com/mdlayher/netlink"
+)
+
+func testLink(index uint32, name string) *rtnetlink.LinkMessage {
+	return &rtnetlink.LinkMessage{
+		Index: index,
+		Attributes: &rtnetlink.LinkAttributes{
+			Name: name,
+			MTU:  1500,
+			Info: &rtnetlink.LinkInfo{Kind: "dummy"},
+		},
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	r := newResolver()
+	r.update(testLink(2, "eth0"))
+	r.update(testLink(3, "eth1"))
+
+	if name, ok := r.Name(2); !ok || name != "eth0" {
+		t.Errorf("unexpected name of index 2: %q, %t", name, ok)
+	}
+	if ifi, ok := r.Interface(3); !ok || ifi.MTU != 1500 || ifi.Kind != "dummy" {
+		t.Errorf("unexpected interface 3: %+v, %t", ifi, ok)
+	}
+
+	// rename
+	r.update(testLink(2, "wan0"))
+	if _, ok := r.Index("eth0"); ok {
+		t.Error("old name still resolves")
+	}
+	if index, ok := r.Index("wan0"); !ok || index != 2 {
+		t.Errorf("unexpected index of wan0: %d, %t", index, ok)
+	}
+
+	r.remove(3)
+	if _, ok := r.Name(3); ok {
+		t.Error("removed interface still resolves")
+	}
+	if _, ok := r.Index("eth1"); ok {
+		t.Error("name of removed interface still resolves")
+	}
+
+	in, out := uint32(2), uint32(7)
+	d := r.Devices(nfqueue.Attribute{InDev: &in, OutDev: &out})
+	if d != (Devices{In: "wan0"}) {
+		t.Errorf("unexpected devices: %+v", d)
+	}
+}
+
+func TestResolverNotifications(t *testing.T) {
+	r := newResolver()
+	r.update(testLink(2, "eth0"))
+	r.update(testLink(3, "eth1"))
+
+	bridged := testLink(2, "eth0")
+	bridged.Family = unix.AF_BRIDGE
+	bridged.Attributes.MTU = 9000
+	removed := testLink(3, "eth1")
+	removed.Family = unix.AF_BRIDGE
+	added := testLink(4, "eth2")
+
+	r.handle(
+		[]rtnetlink.Message{bridged, removed, added},
+		[]netlink.Message{
+			{Header: netlink.Header{Type: unix.RTM_NEWLINK}},
+			{Header: netlink.Header{Type: unix.RTM_DELLINK}},
+			{Header: netlink.Header{Type: unix.RTM_NEWLINK}},
+		},
+	)
+
+	if ifi, ok := r.Interface(2); !ok || ifi.MTU != 1500 {
+		t.Errorf("unexpected interface 2: %+v, %t", ifi, ok)
+	}
+	if name, ok := r.Name(3); !ok || name != "eth1" {
+		t.Errorf("unexpected name of index 3: %q, %t", name, ok)
+	}
+	if index, ok := r.Index("eth2"); !ok || index != 4 {
+		t.Errorf("unexpected index of eth2: %d, %t", index, ok)
+	}
+}
+
+func TestResolverReplace(t *testing.T) {
+	r := newResolver()
+	r.update(testLink(2, "eth0"))
+	r.update(testLink(3, "eth1"))
+
+	r.replace([]rtnetlink.LinkMessage{*testLink(3, "wan0"), *testLink(4, "eth2")})
+
+	if _, ok := r.Name(2); ok {
+		t.Error("removed interface still resolves")
+	}
+	if _, ok := r.Index("eth1"); ok {
+		t.Error("old name still resolves")
+	}
+	if index, ok := r.Index("wan0"); !ok || index != 3 {
+		t.Errorf("unexpected index of wan0: %d, %t", index, ok)
+	}
+	if name, ok := r.Name(4); !ok || name != "eth2" {
+		t.Errorf("unexpected name of index 4: %q, %t", name, ok)
+	}
+}
+
+func TestResolverMiss(t *testing.T) {
+	r := newResolver()
+	var lookups int
+	r.getLink = func(uint32) (rtnetlink.LinkMessage, error) {
+		lookups++
+		return rtnetlink.LinkMessage{}, errors.New("no such device")
+	}
+
+	for range 3 {
+		if _, ok := r.Interface(5); ok {
+			t.Error("unknown interface resolves")
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("unexpected number of lookups: %d", lookups)
+	}
+
+	// A notification for the interface ends the negative caching.
+	r.update(testLink(5, "eth5"))
+	if name, ok := r.Name(5); !ok || name != "eth5" {
+		t.Errorf("unexpected name of index 5: %q, %t", name, ok)
+	}
+	r.remove(5)
+	if _, ok := r.Interface(5); ok || lookups != 2 {
+		t.Errorf("unexpected resolution of removed interface: %t, %d lookups", ok, lookups)
+	}
+}
@@ -9,9 +9,16 @@ import (
 
 // various constants
 const (
-	AF_INET           = linux.AF_INET
-	AF_INET6          = linux.AF_INET6
-	AF_UNSPEC         = linux.AF_UNSPEC
-	NFNETLINK_V0      = linux.NFNETLINK_V0
-	NETLINK_NETFILTER = linux.NETLINK_NETFILTER
+	AF_BRIDGE           = linux.AF_BRIDGE
+	AF_INET             = linux.AF_INET
+	AF_INET6            = linux.AF_INET6
+	AF_UNSPEC           = linux.AF_UNSPEC
+	NFNETLINK_V0        = linux.NFNETLINK_V0
+	NETLINK_NETFILTER   = linux.NETLINK_NETFILTER
+	NFPROTO_BRIDGE      = linux.NFPROTO_BRIDGE
+	RTMGRP_LINK         = linux.RTMGRP_LINK
+	RTM_NEWLINK         = linux.RTM_NEWLINK
+	RTM_DELLINK         = linux.RTM_DELLINK
+	NETLINK_SOCK_DIAG   = linux.NETLINK_SOCK_DIAG
+	SOCK_DIAG_BY_FAMILY = linux.SOCK_DIAG_BY_FAMILY
 )
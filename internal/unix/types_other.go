@@ -4,9 +4,16 @@
 package unix
 
 const (
-	AF_INET           = 0x2
-	AF_INET6          = 0xa
-	AF_UNSPEC         = 0x0
-	NFNETLINK_V0      = 0x0
-	NETLINK_NETFILTER = 0xc
+	AF_BRIDGE           = 0x7
+	AF_INET             = 0x2
+	AF_INET6            = 0xa
+	AF_UNSPEC           = 0x0
+	NFNETLINK_V0        = 0x0
+	NETLINK_NETFILTER   = 0xc
+	NFPROTO_BRIDGE      = 0x7
+	RTMGRP_LINK         = 0x1
+	RTM_NEWLINK         = 0x10
+	RTM_DELLINK         = 0x11
+	NETLINK_SOCK_DIAG   = 0x4
+	SOCK_DIAG_BY_FAMILY = 0x14
 )
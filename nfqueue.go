@@ -2,7 +2,7 @@ package nfqueue
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -22,6 +22,11 @@ func (dn *devNull) Errorf(format string, args ...any) {}
 
 // Close the connection to the netfilter queue subsystem
 func (nfqueue *Nfqueue) Close() error {
+	if nfqueue.batcher != nil {
+		if err := nfqueue.batcher.close(); err != nil {
+			nfqueue.logger.Errorf("Could not set batched verdicts: %v", err)
+		}
+	}
 	err := nfqueue.Con.Close()
 	if nfqueue.ctxCancel != nil {
 		nfqueue.ctxCancel()
@@ -32,61 +37,71 @@ func (nfqueue *Nfqueue) Close() error {
 
 // SetVerdictWithMark signals the kernel the next action and the mark for a specified package id
 //
-// Deprecated: Use SetVerdictWithOption() instead.
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictWithMark(id uint32, verdict, mark int) error {
-	return nfqueue.SetVerdictWithOption(id, verdict, WithMark(uint32(mark)))
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), WithMark(uint32(mark)))
 }
 
 // SetVerdictWithConnMark signals the kernel the next action and the connmark for a specified package id
 //
-// Deprecated: Use SetVerdictWithOption() instead.
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictWithConnMark(id uint32, verdict, mark int) error {
-	return nfqueue.SetVerdictWithOption(id, verdict, WithConnMark(uint32(mark)))
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), WithConnMark(uint32(mark)))
 }
 
 // SetVerdictWithLabel signals the kernel the next action and the label for a specified package id
 //
-// Deprecated: Use SetVerdictWithOption() instead.
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictWithLabel(id uint32, verdict int, label []byte) error {
-	return nfqueue.SetVerdictWithOption(id, verdict, WithLabel(label))
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), WithLabel(label))
 }
 
 // SetVerdictModPacket signals the kernel the next action for an altered packet
 //
-// Deprecated: Use SetVerdictWithOption() instead.
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictModPacket(id uint32, verdict int, packet []byte) error {
-	return nfqueue.SetVerdictWithOption(id, verdict, WithAlteredPacket(packet))
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), WithAlteredPacket(packet))
 }
 
 // SetVerdictModPacketWithMark signals the kernel the next action and mark for an altered packet
 //
-// Deprecated: Use SetVerdictWithOption() instead.
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictModPacketWithMark(id uint32, verdict, mark int, packet []byte) error {
-	return nfqueue.SetVerdictWithOption(id, verdict, WithMark(uint32(mark)), WithAlteredPacket(packet))
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), WithMark(uint32(mark)), WithAlteredPacket(packet))
 }
 
 // SetVerdictModPacketWithConnMark signals the kernel the next action and connmark for an altered packet
 //
-// Deprecated: Use SetVerdictWithOption() instead.
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictModPacketWithConnMark(id uint32, verdict, mark int, packet []byte) error {
-	return nfqueue.SetVerdictWithOption(id, verdict, WithConnMark(uint32(mark)), WithAlteredPacket(packet))
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), WithConnMark(uint32(mark)), WithAlteredPacket(packet))
 }
 
 // SetVerdictModPacketWithLabel signals the kernel the next action and label for an altered packet
 //
-// Deprecated: Use SetVerdictWithOption() instead.
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictModPacketWithLabel(id uint32, verdict int, label []byte, packet []byte) error {
-	return nfqueue.SetVerdictWithOption(id, verdict, WithAlteredPacket(packet), WithLabel(label))
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), WithAlteredPacket(packet), WithLabel(label))
 }
 
 // SetVerdict signals the kernel the next action for a specified package id
+//
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdict(id uint32, verdict int) error {
-	return nfqueue.setVerdict(id, verdict, false, []byte{})
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict))
 }
 
 // SetVerdictBatch signals the kernel the next action for a batch of packages till id
+//
+// Deprecated: Use SetPacketVerdictBatch() instead.
 func (nfqueue *Nfqueue) SetVerdictBatch(id uint32, verdict int) error {
-	return nfqueue.setVerdict(id, verdict, true, []byte{})
+	return nfqueue.SetPacketVerdictBatch(id, Verdict(verdict))
+}
+
+// Batcher returns the Batcher to set verdicts in batches. It is nil, unless
+// Config.Batch is set.
+func (nfqueue *Nfqueue) Batcher() *Batcher {
+	return nfqueue.batcher
 }
 
 // SetOption allows to enable or disable netlink socket options.
@@ -103,6 +118,11 @@ func (nfqueue *Nfqueue) SetOption(o netlink.ConnOption, enable bool) error {
 // Deprecated: Use RegisterWithErrorFunc() instead.
 func (nfqueue *Nfqueue) Register(ctx context.Context, fn HookFunc) error {
 	return nfqueue.RegisterWithErrorFunc(ctx, fn, func(err error) int {
+		var parseError *ParseError
+		if errors.As(err, &parseError) {
+			nfqueue.logger.Errorf("Could not parse message: %v", err)
+			return 0
+		}
 		if opError, ok := err.(*netlink.OpError); ok {
 			if opError.Timeout() || opError.Temporary() {
 				return 0
@@ -115,49 +135,66 @@ func (nfqueue *Nfqueue) Register(ctx context.Context, fn HookFunc) error {
 
 // RegisterWithErrorFunc attaches a callback function to a netfilter queue and allows
 // custom error handling for errors encountered when reading from the underlying netlink socket.
+//
+// Messages, that could not be parsed, are reported to errfn as *ParseError after
+// Config.ParsePolicy was applied.
 func (nfqueue *Nfqueue) RegisterWithErrorFunc(ctx context.Context, fn HookFunc, errfn ErrorFunc) error {
+	return nfqueue.register(ctx, func(p *Packet) int {
+		return fn(p.Attribute())
+	}, errfn)
+}
+
+// RegisterPacketFunc attaches a callback function to a netfilter queue, that receives
+// each packet as Packet instead of Attribute, and allows custom error handling for errors
+// encountered when reading from the underlying netlink socket.
+//
+// If Config.ZeroCopy is set, the Packet passed to fn is reused for the next packet and
+// is therefore only valid until fn returns.
+func (nfqueue *Nfqueue) RegisterPacketFunc(ctx context.Context, fn PacketFunc, errfn ErrorFunc) error {
+	return nfqueue.register(ctx, fn, errfn)
+}
+
+func (nfqueue *Nfqueue) register(ctx context.Context, fn PacketFunc, errfn ErrorFunc) error {
 	// unbinding existing handler (if any)
-	seq, err := nfqueue.setConfig(unix.AF_UNSPEC, 0, 0, []netlink.Attribute{
-		{Type: nfQaCfgCmd, Data: []byte{nfUlnlCfgCmdPfUnbind, 0x0, 0x0, byte(nfqueue.family)}},
+	seq, err := nfqueue.setConfig(unix.AF_UNSPEC, 0, 0, ConfigMessage{
+		Command: &ConfigCommand{Command: nfUlnlCfgCmdPfUnbind, PF: uint16(nfqueue.family)},
 	})
 	if err != nil {
 		return fmt.Errorf("could not unbind existing handlers (if any): %w", err)
 	}
 
 	// binding to family
-	_, err = nfqueue.setConfig(unix.AF_UNSPEC, seq, 0, []netlink.Attribute{
-		{Type: nfQaCfgCmd, Data: []byte{nfUlnlCfgCmdPfBind, 0x0, 0x0, byte(nfqueue.family)}},
+	_, err = nfqueue.setConfig(unix.AF_UNSPEC, seq, 0, ConfigMessage{
+		Command: &ConfigCommand{Command: nfUlnlCfgCmdPfBind, PF: uint16(nfqueue.family)},
 	})
 	if err != nil {
 		return fmt.Errorf("could not bind to family %d: %w", nfqueue.family, err)
 	}
 
 	// binding to the requested queue
-	_, err = nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, []netlink.Attribute{
-		{Type: nfQaCfgCmd, Data: []byte{nfUlnlCfgCmdBind, 0x0, 0x0, byte(nfqueue.family)}},
+	_, err = nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, ConfigMessage{
+		Command: &ConfigCommand{Command: nfUlnlCfgCmdBind, PF: uint16(nfqueue.family)},
 	})
 	if err != nil {
 		return fmt.Errorf("could not bind to requested queue %d: %w", nfqueue.queue, err)
 	}
 
 	// set copy mode and buffer size
-	data := append(nfqueue.maxPacketLen, nfqueue.copymode)
-	_, err = nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, []netlink.Attribute{
-		{Type: nfQaCfgParams, Data: data},
+	_, err = nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, ConfigMessage{
+		Params: &ConfigParams{CopyRange: nfqueue.maxPacketLen, CopyMode: nfqueue.copymode},
 	})
 	if err != nil {
 		return err
 	}
 
-	var attrs []netlink.Attribute
-	if nfqueue.flags[0] != 0 || nfqueue.flags[1] != 0 || nfqueue.flags[2] != 0 || nfqueue.flags[3] != 0 {
+	cfg := ConfigMessage{QueueMaxLen: &nfqueue.maxQueueLen}
+	if nfqueue.flags != 0 {
 		// set flags
-		attrs = append(attrs, netlink.Attribute{Type: nfQaCfgFlags, Data: nfqueue.flags})
-		attrs = append(attrs, netlink.Attribute{Type: nfQaCfgMask, Data: nfqueue.flags})
+		cfg.Flags = &nfqueue.flags
+		cfg.Mask = &nfqueue.flags
 	}
-	attrs = append(attrs, netlink.Attribute{Type: nfQaCfgQueueMaxLen, Data: nfqueue.maxQueueLen})
 
-	_, err = nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, attrs)
+	_, err = nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, cfg)
 	if err != nil {
 		return err
 	}
@@ -165,6 +202,11 @@ func (nfqueue *Nfqueue) RegisterWithErrorFunc(ctx context.Context, fn HookFunc,
 	internalCtx, cancel := context.WithCancel(ctx)
 	nfqueue.ctxCancel = cancel
 
+	if nfqueue.acks != nil {
+		// Verdicts wait for acknowledgments as soon as the callback is registered.
+		nfqueue.acks.start()
+	}
+
 	nfqueue.wg.Add(1)
 	go func() {
 		defer nfqueue.wg.Done()
@@ -174,28 +216,13 @@ func (nfqueue *Nfqueue) RegisterWithErrorFunc(ctx context.Context, fn HookFunc,
 	return nil
 }
 
-// /include/uapi/linux/netfilter/nfnetlink.h:struct nfgenmsg{} res_id is Big Endian
-func putExtraHeader(familiy, version uint8, resid uint16) []byte {
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, resid)
-	return append([]byte{familiy, version}, buf...)
-}
-
-func (nfqueue *Nfqueue) setConfig(afFamily uint8, oseq uint32, resid uint16, attrs []netlink.Attribute) (uint32, error) {
-	cmd, err := netlink.MarshalAttributes(attrs)
+func (nfqueue *Nfqueue) setConfig(afFamily uint8, oseq uint32, resid uint16, cfg ConfigMessage) (uint32, error) {
+	req, err := MarshalConfig(afFamily, resid, cfg)
 	if err != nil {
 		return 0, err
 	}
-	data := putExtraHeader(afFamily, unix.NFNETLINK_V0, resid)
-	data = append(data, cmd...)
-	req := netlink.Message{
-		Header: netlink.Header{
-			Type:     netlink.HeaderType((nfnlSubSysQueue << 8) | nfQnlMsgConfig),
-			Flags:    netlink.Request | netlink.Acknowledge,
-			Sequence: oseq,
-		},
-		Data: data,
-	}
+	req.Header.Flags = netlink.Request | netlink.Acknowledge
+	req.Header.Sequence = oseq
 	return nfqueue.execute(req)
 }
 
@@ -220,12 +247,17 @@ func (nfqueue *Nfqueue) execute(req netlink.Message) (uint32, error) {
 	return seq, nil
 }
 
-func parseMsg(log Logger, msg netlink.Message) (Attribute, error) {
-	a, err := extractAttributes(log, msg.Data)
-	if err != nil {
-		return a, err
+func (nfqueue *Nfqueue) parseMsg(msg netlink.Message) (*Packet, error) {
+	p := nfqueue.packet
+	if p == nil {
+		p = new(Packet)
+	} else {
+		*p = Packet{}
+	}
+	if err := extractPacket(nfqueue.logger, p, msg.Data, nfqueue.zeroCopy); err != nil {
+		return p, err
 	}
-	return a, nil
+	return p, nil
 }
 
 // Nfqueue represents a netfilter queue handler
@@ -238,13 +270,29 @@ type Nfqueue struct {
 	wg        sync.WaitGroup
 	ctxCancel context.CancelFunc
 
-	flags        []byte // uint32
-	maxPacketLen []byte // uint32
+	flags        uint32
+	maxPacketLen uint32
 	family       uint8
 	queue        uint16
-	maxQueueLen  []byte // uint32
+	maxQueueLen  uint32
 	copymode     uint8
 
+	// zeroCopy lets Packet refer to the receive buffer and reuses
+	// packet for every received message.
+	zeroCopy bool
+	packet   *Packet
+
+	parsePolicy ParsePolicy
+
+	// batcher tracks the queued packets, if verdicts are batched.
+	batcher *Batcher
+
+	// acks matches acknowledgments to verdicts, if verdicts are acknowledged.
+	acks *acks
+
+	// ackTimeout limits the wait for an acknowledgment.
+	ackTimeout time.Duration
+
 	setWriteTimeout func() error
 }
 
@@ -262,24 +310,25 @@ func Open(config *Config) (*Nfqueue, error) {
 		return nil, ErrInvFlag
 	}
 
+	if config.AfFamily != unix.AF_UNSPEC && !isSupportedFamily(config.AfFamily) {
+		return nil, ErrInvFamily
+	}
+
 	con, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: config.NetNS})
 	if err != nil {
 		return nil, err
 	}
 	nfqueue.Con = con
 	// default size of copied packages to userspace
-	nfqueue.maxPacketLen = []byte{0x00, 0x00, 0x00, 0x00}
-	binary.BigEndian.PutUint32(nfqueue.maxPacketLen, config.MaxPacketLen)
-	nfqueue.flags = []byte{0x00, 0x00, 0x00, 0x00}
-	binary.BigEndian.PutUint32(nfqueue.flags, config.Flags)
+	nfqueue.maxPacketLen = config.MaxPacketLen
+	nfqueue.flags = config.Flags
 	nfqueue.queue = config.NfQueue
 	nfqueue.family = config.AfFamily
 
-	nfqueue.maxQueueLen = []byte{0x00, 0x00, 0x00, 0x00}
-	if config.MaxQueueLen == 0 {
-		config.MaxQueueLen = kernelDefaultMaxQueueLen
+	nfqueue.maxQueueLen = config.MaxQueueLen
+	if nfqueue.maxQueueLen == 0 {
+		nfqueue.maxQueueLen = kernelDefaultMaxQueueLen
 	}
-	binary.BigEndian.PutUint32(nfqueue.maxQueueLen, config.MaxQueueLen)
 
 	if config.Logger == nil {
 		nfqueue.logger = new(devNull)
@@ -287,6 +336,24 @@ func Open(config *Config) (*Nfqueue, error) {
 		nfqueue.logger = config.Logger
 	}
 	nfqueue.copymode = config.Copymode
+	nfqueue.parsePolicy = config.ParsePolicy
+
+	if config.Batch != nil {
+		nfqueue.batcher = newBatcher(nfqueue.setVerdict, nfqueue.logger, *config.Batch)
+	}
+
+	if config.ZeroCopy {
+		nfqueue.zeroCopy = true
+		nfqueue.packet = new(Packet)
+	}
+
+	if config.AckVerdicts {
+		nfqueue.acks = newAcks(nfqueue.logger)
+		nfqueue.ackTimeout = config.WriteTimeout
+		if nfqueue.ackTimeout <= 0 {
+			nfqueue.ackTimeout = DefaultAckTimeout
+		}
+	}
 
 	if config.WriteTimeout > 0 {
 		nfqueue.setWriteTimeout = func() error {
@@ -300,55 +367,60 @@ func Open(config *Config) (*Nfqueue, error) {
 	return &nfqueue, nil
 }
 
-func (nfqueue *Nfqueue) setVerdict(id uint32, verdict int, batch bool, attributes []byte) error {
-	/*
-		struct nfqnl_msg_verdict_hdr {
-			__be32 verdict;
-			__be32 id;
-		};
-	*/
-
-	if verdict != NfDrop && verdict != NfAccept && verdict != NfStolen && verdict != NfQeueue && verdict != NfRepeat {
+func (nfqueue *Nfqueue) setVerdict(v VerdictMessage) error {
+	if !v.Verdict.Valid() {
 		return ErrInvalidVerdict
 	}
 
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(id))
-	verdictData := append([]byte{0x0, 0x0, 0x0, byte(verdict)}, buf...)
-	cmd, err := netlink.MarshalAttributes([]netlink.Attribute{
-		{Type: nfQaVerdictHdr, Data: verdictData},
-	})
+	req, err := MarshalVerdict(nfqueue.family, nfqueue.queue, v)
 	if err != nil {
 		return err
 	}
-	data := putExtraHeader(nfqueue.family, unix.NFNETLINK_V0, nfqueue.queue)
-	data = append(data, cmd...)
-	data = append(data, attributes...)
-	req := netlink.Message{
-		Header: netlink.Header{
-			Flags:    netlink.Request,
-			Sequence: 0,
-		},
-		Data: data,
-	}
-	if batch {
-		req.Header.Type = netlink.HeaderType((nfnlSubSysQueue << 8) | nfQnlMsgVerdictBatch)
-	} else {
-		req.Header.Type = netlink.HeaderType((nfnlSubSysQueue << 8) | nfQnlMsgVerdict)
-	}
+	req.Header.Flags = netlink.Request
 
 	if err := nfqueue.setWriteTimeout(); err != nil {
 		nfqueue.logger.Errorf("could not set write timeout: %v\n", err)
 	}
+	if nfqueue.acks != nil {
+		return nfqueue.waitAck(req)
+	}
 	_, sErr := nfqueue.Con.Send(req)
 	return sErr
 }
 
-func (nfqueue *Nfqueue) socketCallback(ctx context.Context, fn HookFunc, errfn ErrorFunc, seq uint32) {
+// applyParsePolicy sets the verdict for a packet, that could not be parsed,
+// according to the configured ParsePolicy.
+func (nfqueue *Nfqueue) applyParsePolicy(err error) {
+	var parseError *ParseError
+	if !errors.As(err, &parseError) || !parseError.HasPacketID {
+		return
+	}
+	setVerdict := func(id uint32, verdict Verdict) error {
+		return nfqueue.SetPacketVerdict(id, verdict)
+	}
+	if nfqueue.batcher != nil {
+		nfqueue.batcher.register(parseError.PacketID)
+		setVerdict = nfqueue.batcher.SetVerdict
+	}
+	var verdict Verdict
+	switch nfqueue.parsePolicy {
+	case ParsePolicyAccept:
+		verdict = NfAccept
+	case ParsePolicyDrop:
+		verdict = NfDrop
+	default:
+		return
+	}
+	if err := setVerdict(parseError.PacketID, verdict); err != nil {
+		nfqueue.logger.Errorf("Could not set verdict for unparseable packet %d: %v", parseError.PacketID, err)
+	}
+}
+
+func (nfqueue *Nfqueue) socketCallback(ctx context.Context, fn PacketFunc, errfn ErrorFunc, seq uint32) {
 	defer func() {
 		// unbinding from queue
-		_, err := nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, []netlink.Attribute{
-			{Type: nfQaCfgCmd, Data: []byte{nfUlnlCfgCmdUnbind, 0x0, 0x0, byte(nfqueue.family)}},
+		_, err := nfqueue.setConfig(uint8(unix.AF_UNSPEC), seq, nfqueue.queue, ConfigMessage{
+			Command: &ConfigCommand{Command: nfUlnlCfgCmdUnbind, PF: uint16(nfqueue.family)},
 		})
 		if err != nil {
 			nfqueue.logger.Errorf("Could not unbind from queue: %v", err)
@@ -366,12 +438,19 @@ func (nfqueue *Nfqueue) socketCallback(ctx context.Context, fn HookFunc, errfn E
 		nfqueue.Con.SetReadDeadline(time.Now().Add(-1 * time.Second))
 	}()
 
+	receive := nfqueue.Con.Receive
+	if nfqueue.acks != nil {
+		var stop func()
+		receive, stop = nfqueue.startReceiver(ctx)
+		defer stop()
+	}
+
 	for {
 		if err := ctx.Err(); err != nil {
 			nfqueue.logger.Errorf("Stop receiving nfqueue messages: %v", err)
 			return
 		}
-		replys, err := nfqueue.Con.Receive()
+		replys, err := receive()
 		if err != nil {
 			if ret := errfn(err); ret != 0 {
 				return
@@ -384,11 +463,17 @@ func (nfqueue *Nfqueue) socketCallback(ctx context.Context, fn HookFunc, errfn E
 				// continue to receive messages
 				break
 			}
-			m, err := parseMsg(nfqueue.logger, msg)
+			m, err := nfqueue.parseMsg(msg)
 			if err != nil {
-				nfqueue.logger.Errorf("Could not parse message: %v", err)
+				nfqueue.applyParsePolicy(err)
+				if ret := errfn(err); ret != 0 {
+					return
+				}
 				continue
 			}
+			if nfqueue.batcher != nil && m.Has(FieldPacketID) {
+				nfqueue.batcher.register(m.PacketID)
+			}
 			if ret := fn(m); ret != 0 {
 				return
 			}
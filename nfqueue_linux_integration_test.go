@@ -4,6 +4,7 @@ package nfqueue
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os/exec"
@@ -57,7 +58,7 @@ func TestLinuxNfqueue(t *testing.T) {
 		id := *a.PacketID
 		// Just print out the id and payload of the nfqueue packet
 		t.Logf("[%d]\t%v\n", id, *a.Payload)
-		nfq.SetVerdict(id, NfAccept)
+		nfq.SetPacketVerdict(id, NfAccept)
 		return 0
 	}
 
@@ -92,7 +93,7 @@ func TestTimeout(t *testing.T) {
 		id := *a.PacketID
 		// Just print out the id and payload of the nfqueue packet
 		t.Logf("[%d]\t%v\n", id, *a.Payload)
-		nfq.SetVerdict(id, NfAccept)
+		nfq.SetPacketVerdict(id, NfAccept)
 		return 0
 	}
 
@@ -109,6 +110,49 @@ func TestTimeout(t *testing.T) {
 	<-ctx.Done()
 }
 
+func TestAckVerdicts(t *testing.T) {
+	config := Config{
+		NfQueue:      124,
+		MaxPacketLen: 0xFFFF,
+		Copymode:     NfQnlCopyPacket,
+		WriteTimeout: 5 * time.Second,
+		AckVerdicts:  true,
+	}
+
+	nfq, err := Open(&config)
+	if err != nil {
+		t.Fatalf("failed to open nfqueue socket: %v", err)
+	}
+	defer nfq.Close()
+
+	if err := nfq.SetPacketVerdict(1, NfAccept); !errors.Is(err, ErrNotReceiving) {
+		t.Errorf("unexpected error without registered callback: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = nfq.RegisterWithErrorFunc(ctx, func(a Attribute) int {
+		nfq.SetPacketVerdict(*a.PacketID, NfAccept)
+		return 0
+	}, func(err error) int {
+		if ctx.Err() == nil {
+			t.Errorf("unexpected error in receive loop: %v", err)
+		}
+		return 1
+	})
+	if err != nil {
+		t.Fatalf("failed to register hook function: %v", err)
+	}
+
+	// The kernel does not know the packet ID.
+	for range 3 {
+		if err := nfq.SetPacketVerdict(0xdead, NfAccept); !errors.Is(err, unix.ENOENT) {
+			t.Errorf("unexpected error for unknown packet: %v", err)
+		}
+	}
+}
+
 // TODO: check if lo is already up.
 // TODO: if lo is not up yet, turn it down after the test again.
 func changeLoIFaceState(t *testing.T) error {
@@ -179,7 +223,7 @@ table inet test-nfqueue {
 		var callbackFired atomic.Bool
 		err = nfq.RegisterWithErrorFunc(ctx, func(a Attribute) int {
 			callbackFired.Store(true)
-			nfq.SetVerdict(*a.PacketID, NfAccept)
+			nfq.SetPacketVerdict(*a.PacketID, NfAccept)
 			return 0
 		}, func(err error) int {
 			// Timeouts return an error "netlink receive: use of closed file".
@@ -0,0 +1,100 @@
+package owner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+)
+
+const (
+	// sizeof(struct inet_diag_req_v2)
+	inetDiagReqV2Len = 56
+	// sizeof(struct inet_diag_msg)
+	inetDiagMsgLen = 72
+	// INET_DIAG_NOCOOKIE
+	inetDiagNoCookie = ^uint32(0)
+)
+
+// marshalDiagReq returns struct inet_diag_req_v2 for an exact lookup of the
+// socket with the given addresses.
+func marshalDiagReq(family, protocol uint8, src, dst netip.AddrPort) []byte {
+	/*
+		struct inet_diag_req_v2 {
+			__u8	sdiag_family;
+			__u8	sdiag_protocol;
+			__u8	idiag_ext;
+			__u8	pad;
+			__u32	idiag_states;
+			struct inet_diag_sockid id;
+		};
+
+		struct inet_diag_sockid {
+			__be16	idiag_sport;
+			__be16	idiag_dport;
+			__be32	idiag_src[4];
+			__be32	idiag_dst[4];
+			__u32	idiag_if;
+			__u32	idiag_cookie[2];
+		};
+	*/
+	b := make([]byte, inetDiagReqV2Len)
+	b[0] = family
+	b[1] = protocol
+	// all states
+	binary.NativeEndian.PutUint32(b[4:8], ^uint32(0))
+	binary.BigEndian.PutUint16(b[8:10], src.Port())
+	binary.BigEndian.PutUint16(b[10:12], dst.Port())
+	putDiagAddr(b[12:28], family, src.Addr())
+	putDiagAddr(b[28:44], family, dst.Addr())
+	binary.NativeEndian.PutUint32(b[48:52], inetDiagNoCookie)
+	binary.NativeEndian.PutUint32(b[52:56], inetDiagNoCookie)
+	return b
+}
+
+func putDiagAddr(b []byte, family uint8, addr netip.Addr) {
+	if family == unix.AF_INET {
+		a := addr.As4()
+		copy(b, a[:])
+		return
+	}
+	a := addr.As16()
+	copy(b, a[:])
+}
+
+// Socket contains the socket information reported by sock_diag.
+type Socket struct {
+	Family uint8
+	// State is the TCP state of the socket.
+	State uint8
+	UID   uint32
+	Inode uint32
+}
+
+// unmarshalDiagMsg decodes struct inet_diag_msg.
+func unmarshalDiagMsg(b []byte) (Socket, error) {
+	/*
+		struct inet_diag_msg {
+			__u8	idiag_family;
+			__u8	idiag_state;
+			__u8	idiag_timer;
+			__u8	idiag_retrans;
+			struct inet_diag_sockid id;
+			__u32	idiag_expires;
+			__u32	idiag_rqueue;
+			__u32	idiag_wqueue;
+			__u32	idiag_uid;
+			__u32	idiag_inode;
+		};
+	*/
+	if len(b) < inetDiagMsgLen {
+		return Socket{}, fmt.Errorf("inet_diag_msg: insufficient data length: %d", len(b))
+	}
+	return Socket{
+		Family: b[0],
+		State:  b[1],
+		UID:    binary.NativeEndian.Uint32(b[64:68]),
+		Inode:  binary.NativeEndian.Uint32(b[68:72]),
+	}, nil
+}
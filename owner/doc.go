@@ -0,0 +1,9 @@
+/*
+Package owner attributes queued packets to the sockets and processes, that
+send or receive them.
+
+The socket of a packet is looked up by its 5-tuple via sock_diag (inet_diag).
+The process owning the socket is found by scanning the file descriptors of all
+processes in procfs.
+*/
+package owner
@@ -0,0 +1,309 @@
+package owner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/netip"
+	"sync"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/florianl/go-nfqueue/v2/header"
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Defaults of a Resolver.
+const (
+	DefaultProcRoot = "/proc"
+	DefaultCacheTTL = 5 * time.Second
+)
+
+// minRescanInterval limits the rate of procfs scans for sockets, that are
+// not known yet.
+const minRescanInterval = 100 * time.Millisecond
+
+// Various errors
+var (
+	ErrNotFound    = errors.New("socket not found")
+	ErrUnsupported = errors.New("unsupported protocol")
+)
+
+// Config contains options for a Resolver.
+type Config struct {
+	// Network namespace the Resolver needs to operate in. If set to 0 (default),
+	// no network namespace will be entered.
+	NetNS int
+
+	// ProcRoot is the mount point of procfs, whose processes own the sockets.
+	// If not set, DefaultProcRoot is used.
+	ProcRoot string
+
+	// CacheTTL defines how long lookup results are cached. Expired results
+	// are removed at most once per CacheTTL. If not set, DefaultCacheTTL
+	// is used.
+	CacheTTL time.Duration
+}
+
+// Owner contains the socket of a packet and the process owning it.
+type Owner struct {
+	Socket Socket
+	// Process is nil, if no process in ProcRoot owns the socket. Such
+	// results are not cached, as the owner might not be known yet.
+	Process *Process
+}
+
+type ownerKey struct {
+	protocol uint8
+	local    netip.AddrPort
+	remote   netip.AddrPort
+}
+
+type ownerEntry struct {
+	owner   Owner
+	expires time.Time
+}
+
+// processKey identifies a process. The start time tells processes with a
+// reused PID apart.
+type processKey struct {
+	pid   int
+	start uint64
+}
+
+type processEntry struct {
+	process *Process
+	expires time.Time
+}
+
+// Resolver looks up the owners of packets.
+type Resolver struct {
+	conn     *netlink.Conn
+	procRoot string
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	owners    map[ownerKey]ownerEntry
+	processes map[processKey]processEntry
+	// sockets maps socket inodes to PIDs
+	sockets map[uint32]int
+	scanned time.Time
+	pruned  time.Time
+}
+
+// New returns a Resolver for the network namespace given in config.
+func New(config Config) (*Resolver, error) {
+	con, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, &netlink.Config{NetNS: config.NetNS})
+	if err != nil {
+		return nil, err
+	}
+	r := newResolver(config)
+	r.conn = con
+	return r, nil
+}
+
+func newResolver(config Config) *Resolver {
+	r := &Resolver{
+		procRoot:  config.ProcRoot,
+		ttl:       config.CacheTTL,
+		owners:    make(map[ownerKey]ownerEntry),
+		processes: make(map[processKey]processEntry),
+	}
+	if r.procRoot == "" {
+		r.procRoot = DefaultProcRoot
+	}
+	if r.ttl <= 0 {
+		r.ttl = DefaultCacheTTL
+	}
+	return r
+}
+
+// Close closes the sock_diag connection of r.
+func (r *Resolver) Close() error {
+	return r.conn.Close()
+}
+
+// LookupPacket returns the owner of a queued TCP or UDP packet. hook is used
+// to tell the local and the remote end of the packet apart. Packets on
+// HookForward have no local owner.
+func (r *Resolver) LookupPacket(p *header.Packet, hook nfqueue.Hook) (Owner, error) {
+	if p.Protocol != header.ProtocolTCP && p.Protocol != header.ProtocolUDP {
+		return Owner{}, ErrUnsupported
+	}
+	src := netip.AddrPortFrom(p.Src(), p.SrcPort())
+	dst := netip.AddrPortFrom(p.Dst(), p.DstPort())
+
+	switch hook {
+	case nfqueue.HookLocalOut, nfqueue.HookPostRouting:
+		return r.Lookup(p.Protocol, src, dst)
+	case nfqueue.HookPreRouting, nfqueue.HookLocalIn:
+		return r.Lookup(p.Protocol, dst, src)
+	}
+	return Owner{}, ErrNotFound
+}
+
+// Lookup returns the owner of the TCP or UDP socket with the local and remote
+// address.
+func (r *Resolver) Lookup(protocol uint8, local, remote netip.AddrPort) (Owner, error) {
+	if protocol != header.ProtocolTCP && protocol != header.ProtocolUDP {
+		return Owner{}, ErrUnsupported
+	}
+	key := ownerKey{protocol: protocol, local: local, remote: remote}
+	now := time.Now()
+
+	r.mu.Lock()
+	if e, ok := r.owners[key]; ok && now.Before(e.expires) {
+		r.mu.Unlock()
+		return e.owner, nil
+	}
+	r.mu.Unlock()
+
+	s, err := r.lookupSocket(protocol, local, remote)
+	if err != nil {
+		return Owner{}, err
+	}
+	o := Owner{Socket: s}
+	o.Process, err = r.process(s.Inode, now)
+	if err != nil || o.Process == nil {
+		return o, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(now)
+	r.owners[key] = ownerEntry{owner: o, expires: now.Add(r.ttl)}
+	return o, nil
+}
+
+// prune removes expired entries from the caches, if it did not run within
+// the TTL. r.mu must be held.
+func (r *Resolver) prune(now time.Time) {
+	if now.Sub(r.pruned) < r.ttl {
+		return
+	}
+	r.pruned = now
+	maps.DeleteFunc(r.owners, func(_ ownerKey, e ownerEntry) bool {
+		return !now.Before(e.expires)
+	})
+	maps.DeleteFunc(r.processes, func(_ processKey, e processEntry) bool {
+		return !now.Before(e.expires)
+	})
+}
+
+// lookupSocket queries sock_diag for the socket with the given addresses.
+func (r *Resolver) lookupSocket(protocol uint8, local, remote netip.AddrPort) (Socket, error) {
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+
+	family := uint8(unix.AF_INET6)
+	if local.Addr().Is4() {
+		family = unix.AF_INET
+	}
+	s, err := r.diag(family, protocol, local, remote)
+	if errors.Is(err, ErrNotFound) && family == unix.AF_INET {
+		// IPv4 traffic of dual-stack sockets.
+		local = netip.AddrPortFrom(netip.AddrFrom16(local.Addr().As16()), local.Port())
+		remote = netip.AddrPortFrom(netip.AddrFrom16(remote.Addr().As16()), remote.Port())
+		s, err = r.diag(unix.AF_INET6, protocol, local, remote)
+	}
+	return s, err
+}
+
+func (r *Resolver) diag(family, protocol uint8, local, remote netip.AddrPort) (Socket, error) {
+	// The kernel looks up TCP sockets by their local address as source,
+	// but UDP sockets by their remote address as source.
+	src, dst := local, remote
+	if protocol == header.ProtocolUDP {
+		src, dst = remote, local
+	}
+	req := netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.SOCK_DIAG_BY_FAMILY,
+			Flags: netlink.Request,
+		},
+		Data: marshalDiagReq(family, protocol, src, dst),
+	}
+	msgs, err := r.conn.Execute(req)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Socket{}, ErrNotFound
+	}
+	if err != nil {
+		return Socket{}, err
+	}
+	if len(msgs) != 1 {
+		return Socket{}, fmt.Errorf("unexpected number of messages: %d", len(msgs))
+	}
+	return unmarshalDiagMsg(msgs[0].Data)
+}
+
+// process returns the process owning the socket with the given inode. procfs
+// is read without holding r.mu.
+func (r *Resolver) process(inode uint32, now time.Time) (*Process, error) {
+	if inode == 0 {
+		// Connections in the accept queue are not owned by a process yet.
+		return nil, nil
+	}
+	r.mu.Lock()
+	pid, ok := r.sockets[inode]
+	rescan := !ok && now.Sub(r.scanned) >= minRescanInterval
+	if rescan {
+		// Concurrent lookups do not scan again.
+		r.scanned = now
+	}
+	r.mu.Unlock()
+
+	if rescan {
+		sockets, err := scanSockets(r.procRoot)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		// A later scan might have started in the meantime.
+		if r.scanned.Equal(now) {
+			r.sockets = sockets
+		}
+		r.mu.Unlock()
+		pid, ok = sockets[inode]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	start, err := readStartTime(r.procRoot, pid)
+	if err != nil {
+		return nil, r.gone(inode, pid, err)
+	}
+	key := processKey{pid: pid, start: start}
+	r.mu.Lock()
+	e, ok := r.processes[key]
+	r.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.process, nil
+	}
+	p, err := readProcess(r.procRoot, pid)
+	if err != nil {
+		return nil, r.gone(inode, pid, err)
+	}
+	p.StartTime = start
+	r.mu.Lock()
+	r.processes[key] = processEntry{process: p, expires: now.Add(r.ttl)}
+	r.mu.Unlock()
+	return p, nil
+}
+
+// gone forgets the socket inode of pid, if err tells that the process is
+// gone. Other errors are returned.
+func (r *Resolver) gone(inode uint32, pid int, err error) error {
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	r.mu.Lock()
+	if r.sockets[inode] == pid {
+		delete(r.sockets, inode)
+	}
+	r.mu.Unlock()
+	return nil
+}
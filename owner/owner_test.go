@@ -0,0 +1,215 @@
+package owner
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-nfqueue/v2/header"
+	"github.com/florianl/go-nfqueue/v2/internal/unix"
+)
+
+func TestMarshalDiagReq(t *testing.T) {
+	src := netip.MustParseAddrPort("192.0.2.1:40000")
+	dst := netip.MustParseAddrPort("198.51.100.1:443")
+
+	b := marshalDiagReq(unix.AF_INET, header.ProtocolTCP, src, dst)
+	if len(b) != inetDiagReqV2Len {
+		t.Fatalf("unexpected length: %d", len(b))
+	}
+	if b[0] != unix.AF_INET || b[1] != header.ProtocolTCP {
+		t.Errorf("unexpected family %d or protocol %d", b[0], b[1])
+	}
+	if sport, dport := binary.BigEndian.Uint16(b[8:10]), binary.BigEndian.Uint16(b[10:12]); sport != 40000 || dport != 443 {
+		t.Errorf("unexpected ports: %d -> %d", sport, dport)
+	}
+	if a, ok := netip.AddrFromSlice(b[12:16]); !ok || a != src.Addr() {
+		t.Errorf("unexpected source address: %v", b[12:28])
+	}
+	if a, ok := netip.AddrFromSlice(b[28:32]); !ok || a != dst.Addr() {
+		t.Errorf("unexpected destination address: %v", b[28:44])
+	}
+	if cookie := binary.NativeEndian.Uint32(b[48:52]); cookie != inetDiagNoCookie {
+		t.Errorf("unexpected cookie: %#x", cookie)
+	}
+
+	b = marshalDiagReq(unix.AF_INET6, header.ProtocolUDP,
+		netip.MustParseAddrPort("[2001:db8::1]:53"), netip.MustParseAddrPort("[::ffff:192.0.2.1]:54321"))
+	if a, ok := netip.AddrFromSlice(b[28:44]); !ok || a != netip.MustParseAddr("::ffff:192.0.2.1") {
+		t.Errorf("unexpected destination address: %v", b[28:44])
+	}
+}
+
+func TestUnmarshalDiagMsg(t *testing.T) {
+	b := make([]byte, inetDiagMsgLen)
+	b[0], b[1] = unix.AF_INET6, 1
+	binary.NativeEndian.PutUint32(b[64:68], 1000)
+	binary.NativeEndian.PutUint32(b[68:72], 4242)
+
+	s, err := unmarshalDiagMsg(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Family != unix.AF_INET6 || s.State != 1 || s.UID != 1000 || s.Inode != 4242 {
+		t.Errorf("unexpected socket: %+v", s)
+	}
+
+	if _, err := unmarshalDiagMsg(b[:inetDiagMsgLen-1]); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+func writeTestProcess(t *testing.T, procRoot string, pid string, inodes ...string) {
+	t.Helper()
+	writeTestStat(t, procRoot, pid, "1000")
+	dir := filepath.Join(procRoot, pid)
+	if err := os.MkdirAll(filepath.Join(dir, "fd"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"comm":    "curl\n",
+		"cmdline": "curl\x00-s\x00https://example.com\x00",
+		"cgroup":  "0::/user.slice/session-1.scope\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/dev/null", filepath.Join(dir, "fd", "0")); err != nil {
+		t.Fatal(err)
+	}
+	for i, inode := range inodes {
+		if err := os.Symlink("socket:["+inode+"]", filepath.Join(dir, "fd", string(rune('3'+i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeTestStat writes /proc/[pid]/stat with the given start time.
+func writeTestStat(t *testing.T, procRoot string, pid string, start string) {
+	t.Helper()
+	dir := filepath.Join(procRoot, pid)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stat := pid + " (curl) S 1 " + strings.Repeat("0 ", 17) + start + " 0 0\n"
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseStartTime(t *testing.T) {
+	tests := map[string]struct {
+		stat    string
+		start   uint64
+		wantErr bool
+	}{
+		"plain":       {stat: "42 (curl) S 1 42 42 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 12345 1000 200", start: 12345},
+		"comm parens": {stat: "42 (a) b (c)) S 1 42 42 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 678 1000 200", start: 678},
+		"truncated":   {stat: "42 (curl) S 1 42", wantErr: true},
+		"no comm":     {stat: "42 curl S", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			start, err := parseStartTime([]byte(tc.stat))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if start != tc.start {
+				t.Errorf("unexpected start time: %d", start)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	procRoot := t.TempDir()
+	writeTestProcess(t, procRoot, "200", "4242")
+	writeTestProcess(t, procRoot, "100", "4242", "17")
+	if err := os.MkdirAll(filepath.Join(procRoot, "sys"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newResolver(Config{ProcRoot: procRoot})
+	now := time.Now()
+
+	p, err := r.process(4242, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p == nil || p.PID != 100 || p.Comm != "curl" || len(p.Cmdline) != 3 ||
+		p.Cmdline[2] != "https://example.com" || p.Cgroup != "/user.slice/session-1.scope" {
+		t.Errorf("unexpected process: %+v", p)
+	}
+
+	p, err = r.process(17, now)
+	if err != nil || p == nil || p.PID != 100 {
+		t.Errorf("unexpected process of inode 17: %+v, %v", p, err)
+	}
+
+	// Unknown sockets do not trigger a rescan right away.
+	writeTestProcess(t, procRoot, "300", "99")
+	if p, err := r.process(99, now); err != nil || p != nil {
+		t.Errorf("unexpected process of unknown inode: %+v, %v", p, err)
+	}
+	if p, err := r.process(99, now.Add(minRescanInterval)); err != nil || p == nil || p.PID != 300 {
+		t.Errorf("unexpected process after rescan: %+v, %v", p, err)
+	}
+
+	// A new process with a reused PID is not served from the cache.
+	if err := os.WriteFile(filepath.Join(procRoot, "300", "comm"), []byte("wget\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestStat(t, procRoot, "300", "2000")
+	if p, err := r.process(99, now.Add(minRescanInterval)); err != nil || p == nil || p.Comm != "wget" || p.StartTime != 2000 {
+		t.Errorf("unexpected process with reused PID: %+v, %v", p, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	r := newResolver(Config{CacheTTL: time.Second})
+	now := time.Now()
+	r.pruned = now
+	r.owners[ownerKey{local: netip.MustParseAddrPort("192.0.2.1:80")}] = ownerEntry{expires: now.Add(time.Second)}
+	r.owners[ownerKey{local: netip.MustParseAddrPort("192.0.2.1:443")}] = ownerEntry{expires: now.Add(2 * time.Second)}
+	r.processes[processKey{pid: 100, start: 1000}] = processEntry{expires: now.Add(time.Second)}
+
+	// Pruning runs at most once per TTL.
+	r.prune(now.Add(time.Second / 2))
+	if len(r.owners) != 2 || len(r.processes) != 1 {
+		t.Errorf("unexpected pruning: %d owners, %d processes", len(r.owners), len(r.processes))
+	}
+
+	r.prune(now.Add(time.Second))
+	if len(r.owners) != 1 || len(r.processes) != 0 {
+		t.Errorf("unexpected pruning: %d owners, %d processes", len(r.owners), len(r.processes))
+	}
+	if _, ok := r.owners[ownerKey{local: netip.MustParseAddrPort("192.0.2.1:443")}]; !ok {
+		t.Error("unexpired owner was pruned")
+	}
+}
+
+func TestProcessConcurrent(t *testing.T) {
+	procRoot := t.TempDir()
+	writeTestProcess(t, procRoot, "100", "4242")
+	r := newResolver(Config{ProcRoot: procRoot})
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p, err := r.process(4242, time.Now()); err != nil || (p != nil && p.PID != 100) {
+				t.Errorf("unexpected process: %+v, %v", p, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,146 @@
+package owner
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Process contains information about the process owning a socket.
+type Process struct {
+	PID     int
+	Comm    string
+	Exe     string
+	Cmdline []string
+	// Cgroup is the path of the process in the unified cgroup hierarchy.
+	Cgroup string
+	// StartTime is the time the process started after system boot in
+	// clock ticks, see proc_pid_stat(5).
+	StartTime uint64
+}
+
+// scanSockets returns the PIDs of all processes in procRoot by the inodes of
+// their sockets. If a socket is shared, the process with the lowest PID is
+// used.
+func scanSockets(procRoot string) (map[uint32]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	sockets := make(map[uint32]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, e.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// The process is gone or not accessible.
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			inode, ok := parseSocketLink(link)
+			if !ok {
+				continue
+			}
+			if cur, ok := sockets[inode]; !ok || pid < cur {
+				sockets[inode] = pid
+			}
+		}
+	}
+	return sockets, nil
+}
+
+// parseSocketLink returns the inode of a file descriptor link of the form
+// "socket:[inode]".
+func parseSocketLink(link string) (uint32, bool) {
+	s, ok := strings.CutPrefix(link, "socket:[")
+	if !ok {
+		return 0, false
+	}
+	s, ok = strings.CutSuffix(s, "]")
+	if !ok {
+		return 0, false
+	}
+	inode, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(inode), true
+}
+
+// readProcess reads the information about the process pid from procRoot.
+func readProcess(procRoot string, pid int) (*Process, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	p := &Process{PID: pid}
+
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return nil, fmt.Errorf("process %d: %w", pid, err)
+	}
+	p.Comm = strings.TrimSuffix(string(comm), "\n")
+
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		cmdline = bytes.TrimSuffix(cmdline, []byte{0x00})
+		if len(cmdline) > 0 {
+			p.Cmdline = strings.Split(string(cmdline), "\x00")
+		}
+	}
+	// Kernel threads and processes of other users have no accessible
+	// executable.
+	p.Exe, _ = os.Readlink(filepath.Join(dir, "exe"))
+
+	if f, err := os.Open(filepath.Join(dir, "cgroup")); err == nil {
+		p.Cgroup = parseCgroup(f)
+		f.Close()
+	}
+	return p, nil
+}
+
+// readStartTime returns the start time of the process pid from
+// /proc/[pid]/stat.
+func readStartTime(procRoot string, pid int) (uint64, error) {
+	stat, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, fmt.Errorf("process %d: %w", pid, err)
+	}
+	return parseStartTime(stat)
+}
+
+// parseStartTime returns the starttime field of /proc/[pid]/stat. As comm
+// might contain spaces and parentheses, the fields are counted from its end.
+func parseStartTime(stat []byte) (uint64, error) {
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, errors.New("stat: comm not found")
+	}
+	// The fields after comm start with state, the third field.
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 22-2 {
+		return 0, fmt.Errorf("stat: insufficient number of fields: %d", len(fields)+2)
+	}
+	return strconv.ParseUint(fields[22-3], 10, 64)
+}
+
+// parseCgroup returns the path of the unified hierarchy from
+// /proc/[pid]/cgroup.
+func parseCgroup(f *os.File) string {
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if path, ok := strings.CutPrefix(s.Text(), "0::"); ok {
+			return path
+		}
+	}
+	return ""
+}
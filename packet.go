@@ -0,0 +1,163 @@
+package nfqueue
+
+import (
+	"net"
+	"time"
+)
+
+// Packet contains the elements of a queued packet. Unlike Attribute, Packet
+// holds plain values. As not every value is contained in every nfqueue
+// message, Has() reports whether a value was provided by the kernel.
+//
+// Unknown holds the raw data of attributes, that are not supported by this
+// package, keyed by attribute type. It is nil, if there are none. Exp is never
+// provided by the kernel, see Attribute.
+type Packet struct {
+	PacketID   uint32
+	Hook       Hook
+	Timestamp  time.Time
+	Mark       uint32
+	InDev      uint32
+	PhysInDev  uint32
+	OutDev     uint32
+	PhysOutDev uint32
+	Payload    []byte
+	CapLen     uint32
+	UID        uint32
+	GID        uint32
+	SecCtx     string
+	L2Hdr      []byte
+	HwAddr     net.HardwareAddr
+	HwProtocol uint16
+	Ct         []byte
+	CtInfo     CtInfo
+	SkbInfo    []byte
+	Exp        []byte
+	SkbPrio    uint32
+	VLAN       VLAN
+	Family     uint8
+	QueueNum   uint16
+	Unknown    map[uint16][]byte
+
+	fields PacketField
+}
+
+// PacketField identifies a value of a Packet.
+type PacketField uint32
+
+// Values of a Packet
+const (
+	FieldPacketID PacketField = 1 << iota
+	FieldHook
+	FieldTimestamp
+	FieldMark
+	FieldInDev
+	FieldPhysInDev
+	FieldOutDev
+	FieldPhysOutDev
+	FieldPayload
+	FieldCapLen
+	FieldUID
+	FieldGID
+	FieldSecCtx
+	FieldL2Hdr
+	FieldHwAddr
+	FieldHwProtocol
+	FieldCt
+	FieldCtInfo
+	FieldSkbInfo
+	FieldExp
+	FieldSkbPrio
+	FieldVLAN
+	FieldFamily
+	FieldQueueNum
+)
+
+// PacketFunc is a function, that receives packets from a netfilter queue.
+// To stop receiving messages on this PacketFunc, return something different than 0.
+type PacketFunc func(p *Packet) int
+
+// Has reports whether all the given values of the packet were provided by the kernel.
+func (p *Packet) Has(f PacketField) bool {
+	return p.fields&f == f
+}
+
+// Attribute returns the values of the packet as Attribute. The pointers of the
+// returned Attribute refer to the values of p.
+func (p *Packet) Attribute() Attribute {
+	var a Attribute
+	if p.Has(FieldPacketID) {
+		a.PacketID = &p.PacketID
+	}
+	if p.Has(FieldHook) {
+		a.Hook = &p.Hook
+	}
+	if p.Has(FieldTimestamp) {
+		a.Timestamp = &p.Timestamp
+	}
+	if p.Has(FieldMark) {
+		a.Mark = &p.Mark
+	}
+	if p.Has(FieldInDev) {
+		a.InDev = &p.InDev
+	}
+	if p.Has(FieldPhysInDev) {
+		a.PhysInDev = &p.PhysInDev
+	}
+	if p.Has(FieldOutDev) {
+		a.OutDev = &p.OutDev
+	}
+	if p.Has(FieldPhysOutDev) {
+		a.PhysOutDev = &p.PhysOutDev
+	}
+	if p.Has(FieldPayload) {
+		a.Payload = &p.Payload
+	}
+	if p.Has(FieldCapLen) {
+		a.CapLen = &p.CapLen
+	}
+	if p.Has(FieldUID) {
+		a.UID = &p.UID
+	}
+	if p.Has(FieldGID) {
+		a.GID = &p.GID
+	}
+	if p.Has(FieldSecCtx) {
+		a.SecCtx = &p.SecCtx
+	}
+	if p.Has(FieldL2Hdr) {
+		a.L2Hdr = &p.L2Hdr
+	}
+	if p.Has(FieldHwAddr) {
+		a.HwAddr = &p.HwAddr
+	}
+	if p.Has(FieldHwProtocol) {
+		a.HwProtocol = &p.HwProtocol
+	}
+	if p.Has(FieldCt) {
+		a.Ct = &p.Ct
+	}
+	if p.Has(FieldCtInfo) {
+		a.CtInfo = &p.CtInfo
+	}
+	if p.Has(FieldSkbInfo) {
+		a.SkbInfo = &p.SkbInfo
+	}
+	if p.Has(FieldExp) {
+		a.Exp = &p.Exp
+	}
+	if p.Has(FieldSkbPrio) {
+		a.SkbPrio = &p.SkbPrio
+	}
+	if p.Has(FieldVLAN) {
+		a.VLAN = &p.VLAN
+	}
+	if p.Has(FieldFamily) {
+		a.Family = &p.Family
+	}
+	if p.Has(FieldQueueNum) {
+		a.QueueNum = &p.QueueNum
+	}
+	a.Unknown = p.Unknown
+	return a
+}
@@ -0,0 +1,50 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// skb meta information flags of nfQaSkbInfo
+const (
+	nfQaSkbCsumNotReady    = 1 << iota /* packet checksum is not ready yet */
+	nfQaSkbGSO                         /* packet is a GSO packet */
+	nfQaSkbCsumNotVerified             /* packet checksum was not verified */
+)
+
+// SkbInfo holds the skb meta information flags of a queued packet.
+//
+// The kernel only reports these flags, if the queue is configured with
+// NfQaCfgFlagGSO. With this flag set, the kernel hands over GSO packets
+// without segmenting them and does not compute checksums that are offloaded
+// to the hardware. Checksums of packets that have ChecksumNotReady() set
+// must not be validated, as they will be filled in later on. If
+// ChecksumNotVerified() is set, the checksum was not yet verified by the
+// kernel or hardware and needs to be verified by userspace, if required.
+type SkbInfo uint32
+
+// DecodeSkbInfo decodes the skb meta information of Attribute.SkbInfo.
+func DecodeSkbInfo(data []byte) (SkbInfo, error) {
+	if len(data) < 4 {
+		return 0, fmt.Errorf("nfQaSkbInfo: insufficient data length: %d", len(data))
+	}
+	return SkbInfo(binary.BigEndian.Uint32(data[:4])), nil
+}
+
+// IsGSO reports whether the packet is a GSO packet and therefore might
+// be larger than the MTU.
+func (s SkbInfo) IsGSO() bool {
+	return s&nfQaSkbGSO != 0
+}
+
+// ChecksumNotReady reports whether the checksum of the packet is not yet
+// calculated, as this is offloaded to a later stage.
+func (s SkbInfo) ChecksumNotReady() bool {
+	return s&nfQaSkbCsumNotReady != 0
+}
+
+// ChecksumNotVerified reports whether the checksum of the packet was not
+// verified yet.
+func (s SkbInfo) ChecksumNotVerified() bool {
+	return s&nfQaSkbCsumNotVerified != 0
+}
@@ -0,0 +1,44 @@
+package nfqueue
+
+import "testing"
+
+func TestDecodeSkbInfo(t *testing.T) {
+	tests := map[string]struct {
+		data            []byte
+		gso             bool
+		csumNotReady    bool
+		csumNotVerified bool
+		wantErr         bool
+	}{
+		"none":              {data: []byte{0x00, 0x00, 0x00, 0x00}},
+		"csum not ready":    {data: []byte{0x00, 0x00, 0x00, 0x01}, csumNotReady: true},
+		"gso":               {data: []byte{0x00, 0x00, 0x00, 0x02}, gso: true},
+		"csum not verified": {data: []byte{0x00, 0x00, 0x00, 0x04}, csumNotVerified: true},
+		"all": {
+			data:            []byte{0x00, 0x00, 0x00, 0x07},
+			gso:             true,
+			csumNotReady:    true,
+			csumNotVerified: true,
+		},
+		"short":  {data: []byte{0x00, 0x00, 0x01}, wantErr: true},
+		"absent": {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			info, err := DecodeSkbInfo(tc.data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if info.IsGSO() != tc.gso {
+				t.Errorf("unexpected IsGSO: %t", info.IsGSO())
+			}
+			if info.ChecksumNotReady() != tc.csumNotReady {
+				t.Errorf("unexpected ChecksumNotReady: %t", info.ChecksumNotReady())
+			}
+			if info.ChecksumNotVerified() != tc.csumNotVerified {
+				t.Errorf("unexpected ChecksumNotVerified: %t", info.ChecksumNotVerified())
+			}
+		})
+	}
+}
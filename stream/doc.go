@@ -0,0 +1,10 @@
+/*
+Package stream follows TCP flows across packets received from a netfilter
+queue and passes the in-order byte stream of each direction to a handler.
+
+The packets carrying the data of a stream are held without a verdict until the
+handler decides on the data. This allows policies on the application layer,
+e.g. to wait for a complete HTTP request line before accepting or dropping a
+connection.
+*/
+package stream
@@ -0,0 +1,574 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/florianl/go-nfqueue/v2/header"
+)
+
+// Default limits of an Assembler.
+const (
+	DefaultTimeout  = 2 * time.Minute
+	DefaultMaxBytes = 64 << 10
+	DefaultMaxFlows = 65536
+)
+
+// rstWindow is the range of sequence numbers after the next expected one, in
+// which resets are accepted.
+const rstWindow = 1 << 16
+
+// Various errors
+var (
+	ErrNotTCP    = errors.New("packet is not a TCP segment")
+	ErrFragment  = errors.New("packet is an IP fragment")
+	ErrTruncated = errors.New("packet is truncated")
+	ErrClosed    = errors.New("assembler is closed")
+)
+
+// Verdicter signals the kernel the verdict for a queued packet.
+// *nfqueue.Nfqueue and *nfqueue.Batcher implement Verdicter.
+type Verdicter interface {
+	SetPacketVerdict(id uint32, verdict nfqueue.Verdict, options ...nfqueue.VerdictOption) error
+}
+
+// Flow identifies a TCP connection. Client is the endpoint that sent the first
+// packet seen of the connection.
+type Flow struct {
+	Client netip.AddrPort
+	Server netip.AddrPort
+}
+
+// Direction of a stream within a flow.
+type Direction uint8
+
+// Directions of a flow
+const (
+	// ClientToServer is the direction of the first packet seen of a flow.
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+// String returns the name of the direction.
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client to server"
+	case ServerToClient:
+		return "server to client"
+	}
+	return fmt.Sprintf("Direction(%d)", uint8(d))
+}
+
+// Stream contains the in-order data of one direction of a flow.
+type Stream struct {
+	Flow      Flow
+	Direction Direction
+	// Data contains the bytes, that arrived since the last verdict for
+	// this direction. It is only valid until the handler returns.
+	Data []byte
+	// Closed is set, if the sender closed the direction. No more data
+	// will follow.
+	Closed bool
+}
+
+// Result is the decision of a handler.
+type Result struct {
+	// Hold keeps the packets of the stream without verdict. The handler
+	// is called again with the data of the stream, once more data
+	// arrived.
+	Hold bool
+	// Verdict for all held packets of the stream, if Hold is not set.
+	Verdict nfqueue.Verdict
+	// Final applies Verdict to all held and future packets of the flow
+	// in both directions. The handler is not called for the flow again.
+	Final bool
+}
+
+// HandlerFunc is called with new in-order data of a stream. Handlers are called
+// sequentially and must not call methods of the Assembler.
+type HandlerFunc func(s *Stream) Result
+
+// Config contains options for an Assembler.
+type Config struct {
+	// Timeout after which idle flows are discarded. If not set,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Maximum number of bytes buffered per flow. If not set,
+	// DefaultMaxBytes is used. Up to the same number of bytes, that were
+	// decided on, is retained per direction to compare retransmissions.
+	MaxBytes int
+
+	// Maximum number of tracked flows. Packets of new flows beyond this
+	// limit receive DefaultVerdict. If not set, DefaultMaxFlows is used.
+	MaxFlows int
+
+	// DefaultVerdict is applied to held packets of flows, that time out,
+	// exceed MaxBytes or are reset, and to retransmissions, whose data
+	// differs from the received data or is no longer retained. Flows
+	// exceeding MaxBytes receive it as final verdict. The default is
+	// nfqueue.NfDrop.
+	DefaultVerdict nfqueue.Verdict
+
+	// ErrorFunc receives errors that happen while setting verdicts for
+	// timed out flows. Optional.
+	ErrorFunc func(err error)
+}
+
+// Assembler tracks TCP flows and holds the verdicts for their packets until
+// the handler decides on the data of the packets.
+//
+// Packets without payload, like pure acknowledgments, are accepted right away,
+// unless the flow has a final verdict. Flows with a final verdict are kept
+// until they time out, even if they are closed or reset.
+type Assembler struct {
+	v       Verdicter
+	handler HandlerFunc
+	config  Config
+
+	mu     sync.Mutex
+	flows  map[Flow]*flow
+	closed bool
+}
+
+type verdict struct {
+	id      uint32
+	verdict nfqueue.Verdict
+}
+
+type verdicts []verdict
+
+func (vs *verdicts) add(v nfqueue.Verdict, ids ...uint32) {
+	for _, id := range ids {
+		*vs = append(*vs, verdict{id: id, verdict: v})
+	}
+}
+
+type segment struct {
+	id   uint32
+	seq  uint32
+	data []byte
+	fin  bool
+}
+
+func (s *segment) end() uint32 {
+	return s.seq + uint32(len(s.data))
+}
+
+// half is the state of one direction of a flow.
+type half struct {
+	init bool
+	// next expected sequence number
+	next uint32
+	// data that arrived in order, but was not decided on
+	buf []byte
+	// data that was decided on and precedes buf
+	hist []byte
+	// packets of buf
+	held []uint32
+	// out-of-order segments sorted by sequence number
+	ooo    []segment
+	closed bool
+	// verdict of the last decision
+	last nfqueue.Verdict
+}
+
+type flow struct {
+	key   Flow
+	timer *time.Timer
+	dirs  [2]half
+	bytes int
+	// number of decided bytes retained per direction
+	history int
+
+	final   bool
+	verdict nfqueue.Verdict
+	reset   bool
+}
+
+// New returns an Assembler that sets the verdicts for packets via v and
+// passes the data of streams to handler.
+func New(v Verdicter, handler HandlerFunc, config Config) *Assembler {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultMaxBytes
+	}
+	if config.MaxFlows <= 0 {
+		config.MaxFlows = DefaultMaxFlows
+	}
+	return &Assembler{
+		v:       v,
+		handler: handler,
+		config:  config,
+		flows:   make(map[Flow]*flow),
+	}
+}
+
+// Handle processes the queued packet id with the given payload and family,
+// as reported by the netfilter queue.
+//
+// If Handle returns an error, no verdict was set for the packet.
+func (a *Assembler) Handle(id uint32, payload []byte, family uint8) error {
+	p, err := header.Decode(payload, family)
+	if err != nil {
+		return err
+	}
+	if p.IsFragment() {
+		return ErrFragment
+	}
+	if p.Protocol != header.ProtocolTCP {
+		return ErrNotTCP
+	}
+	end := 40 + int(p.IPv6.PayloadLen)
+	if p.Version == 4 {
+		end = int(p.IPv4.TotalLen)
+	}
+	if (p.Version == 4 && p.IPv4.TotalLen == 0) || (p.Version == 6 && p.IPv6.PayloadLen == 0) {
+		// Packets larger than 64 KiB, e.g. of BIG TCP with NfQaCfgFlagGSO,
+		// do not carry their length.
+		end = len(payload)
+	}
+	if len(payload) < end {
+		return ErrTruncated
+	}
+	if end < p.PayloadOffset {
+		return fmt.Errorf("%w: packet length %d below headers", header.ErrInvalidHeader, end)
+	}
+	data := payload[p.PayloadOffset:end]
+	src := netip.AddrPortFrom(p.Src(), p.TCP.SrcPort)
+	dst := netip.AddrPortFrom(p.Dst(), p.TCP.DstPort)
+
+	var vs verdicts
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrClosed
+	}
+	a.segment(&vs, id, src, dst, &p.TCP, data)
+	a.mu.Unlock()
+
+	return a.apply(vs)
+}
+
+// Close discards all flows and applies DefaultVerdict to their held packets.
+func (a *Assembler) Close() error {
+	var vs verdicts
+	a.mu.Lock()
+	a.closed = true
+	for _, f := range a.flows {
+		a.remove(f)
+		f.flush(&vs, a.config.DefaultVerdict)
+	}
+	a.mu.Unlock()
+
+	return a.apply(vs)
+}
+
+func (a *Assembler) segment(vs *verdicts, id uint32, src, dst netip.AddrPort, tcp *header.TCP, data []byte) {
+	dir := ClientToServer
+	f, ok := a.flows[Flow{Client: src, Server: dst}]
+	if !ok {
+		dir = ServerToClient
+		f, ok = a.flows[Flow{Client: dst, Server: src}]
+	}
+	if !ok {
+		if tcp.Has(header.TCPFlagRST) || (len(data) == 0 && !tcp.Has(header.TCPFlagSYN) && !tcp.Has(header.TCPFlagFIN)) {
+			vs.add(nfqueue.NfAccept, id)
+			return
+		}
+		if len(a.flows) >= a.config.MaxFlows {
+			vs.add(a.config.DefaultVerdict, id)
+			return
+		}
+		dir = ClientToServer
+		f = &flow{key: Flow{Client: src, Server: dst}, history: a.config.MaxBytes}
+		f.dirs[ClientToServer].last = nfqueue.NfAccept
+		f.dirs[ServerToClient].last = nfqueue.NfAccept
+		f.timer = time.AfterFunc(a.config.Timeout, func() { a.expire(f) })
+		a.flows[f.key] = f
+	} else {
+		f.timer.Reset(a.config.Timeout)
+	}
+
+	a.process(vs, f, dir, id, tcp, data)
+
+	if f.done() && !f.final {
+		a.remove(f)
+	}
+}
+
+func (a *Assembler) process(vs *verdicts, f *flow, dir Direction, id uint32, tcp *header.TCP, data []byte) {
+	h := &f.dirs[dir]
+	if tcp.Has(header.TCPFlagRST) {
+		// Resets outside of the window might be spoofed and are ignored.
+		if f.acceptable(dir, tcp) {
+			f.reset = true
+			f.flush(vs, a.config.DefaultVerdict)
+		}
+		vs.add(f.packetVerdict(), id)
+		return
+	}
+
+	seq := tcp.Seq
+	if tcp.Has(header.TCPFlagSYN) {
+		// The SYN occupies one sequence number.
+		seq++
+		if !h.init {
+			h.init = true
+			h.next = seq
+		}
+	} else if !h.init {
+		// The flow was picked up after its handshake.
+		h.init = true
+		h.next = seq
+	}
+
+	fin := tcp.Has(header.TCPFlagFIN)
+	if f.final {
+		if fin {
+			h.closed = true
+		}
+		vs.add(f.verdict, id)
+		return
+	}
+	if len(data) == 0 && !fin {
+		vs.add(nfqueue.NfAccept, id)
+		return
+	}
+
+	s := segment{id: id, seq: seq, data: data, fin: fin}
+	if !seqLess(h.next, s.end()+finLen(fin)) {
+		// The segment is a retransmission of received data. If the data
+		// differs, the packet receives DefaultVerdict. If the data was not
+		// decided on, the packet waits for the decision.
+		switch {
+		case !h.matches(s.seq, s.data):
+			vs.add(a.config.DefaultVerdict, id)
+		case len(h.held) > 0:
+			h.held = append(h.held, id)
+		default:
+			vs.add(h.last, id)
+		}
+		return
+	}
+	s.data = bytes.Clone(data)
+	h.insert(s)
+	f.bytes += len(s.data)
+
+	delivered := f.drain(vs, h, a.config.DefaultVerdict)
+	if f.bytes > a.config.MaxBytes {
+		f.decide(vs, a.config.DefaultVerdict)
+		return
+	}
+	if !delivered {
+		return
+	}
+
+	r := a.handler(&Stream{
+		Flow:      f.key,
+		Direction: dir,
+		Data:      h.buf,
+		Closed:    h.closed,
+	})
+	switch {
+	case r.Final:
+		f.decide(vs, r.Verdict)
+	case r.Hold && h.closed:
+		// No more data will arrive for this stream.
+		f.decideHalf(vs, h, a.config.DefaultVerdict)
+	case !r.Hold:
+		f.decideHalf(vs, h, r.Verdict)
+	}
+}
+
+func finLen(fin bool) uint32 {
+	if fin {
+		return 1
+	}
+	return 0
+}
+
+// seqLess reports whether sequence number a is before b.
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// insert adds s to the out-of-order segments of h.
+func (h *half) insert(s segment) {
+	i := len(h.ooo)
+	for i > 0 && seqLess(s.seq, h.ooo[i-1].seq) {
+		i--
+	}
+	h.ooo = append(h.ooo, segment{})
+	copy(h.ooo[i+1:], h.ooo[i:])
+	h.ooo[i] = s
+}
+
+// matches reports whether data, that starts at sequence number seq, agrees
+// with the received data of h. Data, that is no longer retained, does not
+// match.
+func (h *half) matches(seq uint32, data []byte) bool {
+	// offset of seq before the end of the received data
+	off := int(int32(h.next - finLen(h.closed) - seq))
+	n := min(off, len(data))
+	if n <= 0 {
+		return true
+	}
+	i := len(h.hist) + len(h.buf) - off
+	if i < 0 {
+		return false
+	}
+	data = data[:n]
+	if i < len(h.hist) {
+		k := min(len(data), len(h.hist)-i)
+		if !bytes.Equal(data[:k], h.hist[i:i+k]) {
+			return false
+		}
+		data, i = data[k:], len(h.hist)
+	}
+	i -= len(h.hist)
+	return bytes.Equal(data, h.buf[i:i+len(data)])
+}
+
+// drain moves the segments, that continue the stream, to the in-order
+// data of h. Segments, whose data differs from the received data, receive
+// conflict. It reports whether new data was delivered or the stream was closed.
+func (f *flow) drain(vs *verdicts, h *half, conflict nfqueue.Verdict) bool {
+	var delivered bool
+	for len(h.ooo) > 0 && !seqLess(h.next, h.ooo[0].seq) {
+		s := h.ooo[0]
+		h.ooo = h.ooo[1:]
+		f.bytes -= len(s.data)
+		if !h.matches(s.seq, s.data) {
+			vs.add(conflict, s.id)
+			continue
+		}
+		h.held = append(h.held, s.id)
+
+		if seqLess(h.next, s.end()) {
+			data := s.data[h.next-s.seq:]
+			h.buf = append(h.buf, data...)
+			f.bytes += len(data)
+			h.next = s.end()
+			delivered = true
+		}
+		if s.fin && h.next == s.end() && !h.closed {
+			h.closed = true
+			h.next++
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+// decideHalf applies verdict to the held packets of h.
+func (f *flow) decideHalf(vs *verdicts, h *half, verdict nfqueue.Verdict) {
+	vs.add(verdict, h.held...)
+	f.bytes -= len(h.buf)
+	h.hist = append(h.hist, h.buf...)
+	if n := len(h.hist) - f.history; n > 0 {
+		h.hist = h.hist[:copy(h.hist, h.hist[n:])]
+	}
+	h.held = nil
+	h.buf = nil
+	h.last = verdict
+}
+
+// decide sets the final verdict of f.
+func (f *flow) decide(vs *verdicts, verdict nfqueue.Verdict) {
+	f.final = true
+	f.verdict = verdict
+	f.flush(vs, verdict)
+	// Retransmissions receive the final verdict.
+	for i := range f.dirs {
+		f.dirs[i].hist = nil
+	}
+}
+
+// flush applies verdict to all held packets of f.
+func (f *flow) flush(vs *verdicts, verdict nfqueue.Verdict) {
+	for i := range f.dirs {
+		h := &f.dirs[i]
+		f.decideHalf(vs, h, verdict)
+		for _, s := range h.ooo {
+			vs.add(verdict, s.id)
+			f.bytes -= len(s.data)
+		}
+		h.ooo = nil
+	}
+}
+
+// acceptable reports whether the reset tcp, that was sent in direction dir,
+// is within the window of f.
+func (f *flow) acceptable(dir Direction, tcp *header.TCP) bool {
+	if h := &f.dirs[dir]; h.init {
+		return !seqLess(tcp.Seq, h.next) && seqLess(tcp.Seq, h.next+rstWindow)
+	}
+	// The sender did not send before and has to acknowledge the data of
+	// the peer.
+	peer := &f.dirs[1-dir]
+	return tcp.Has(header.TCPFlagACK) && peer.init && tcp.Ack == peer.next
+}
+
+// packetVerdict returns the verdict for packets without data.
+func (f *flow) packetVerdict() nfqueue.Verdict {
+	if f.final {
+		return f.verdict
+	}
+	return nfqueue.NfAccept
+}
+
+// done reports whether f can be removed.
+func (f *flow) done() bool {
+	if f.reset {
+		return true
+	}
+	for i := range f.dirs {
+		h := &f.dirs[i]
+		if !h.closed || len(h.held) > 0 || len(h.ooo) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Assembler) remove(f *flow) {
+	if cur, ok := a.flows[f.key]; ok && cur == f {
+		delete(a.flows, f.key)
+		f.timer.Stop()
+	}
+}
+
+func (a *Assembler) expire(f *flow) {
+	var vs verdicts
+	a.mu.Lock()
+	if cur, ok := a.flows[f.key]; !ok || cur != f {
+		a.mu.Unlock()
+		return
+	}
+	a.remove(f)
+	f.flush(&vs, a.config.DefaultVerdict)
+	a.mu.Unlock()
+
+	if err := a.apply(vs); err != nil && a.config.ErrorFunc != nil {
+		a.config.ErrorFunc(err)
+	}
+}
+
+func (a *Assembler) apply(vs verdicts) error {
+	var errs []error
+	for _, v := range vs {
+		if err := a.v.SetPacketVerdict(v.id, v.verdict); err != nil {
+			errs = append(errs, fmt.Errorf("could not set verdict for packet %d: %w", v.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
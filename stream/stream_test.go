@@ -0,0 +1,338 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/florianl/go-nfqueue/v2/header"
+)
+
+type testVerdicter struct {
+	mu       sync.Mutex
+	verdicts map[uint32]nfqueue.Verdict
+}
+
+func (v *testVerdicter) SetPacketVerdict(id uint32, verdict nfqueue.Verdict, _ ...nfqueue.VerdictOption) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.verdicts == nil {
+		v.verdicts = make(map[uint32]nfqueue.Verdict)
+	}
+	v.verdicts[id] = verdict
+	return nil
+}
+
+var (
+	_ Verdicter = (*nfqueue.Nfqueue)(nil)
+	_ Verdicter = (*nfqueue.Batcher)(nil)
+)
+
+func (v *testVerdicter) get(id uint32) (nfqueue.Verdict, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	verdict, ok := v.verdicts[id]
+	return verdict, ok
+}
+
+// testSegment returns an IPv4 TCP packet from 192.0.2.1:40000 to
+// 198.51.100.1:80 or in reverse direction.
+func testSegment(reply bool, seq, ack uint32, flags header.TCPFlags, data string) []byte {
+	b := []byte{
+		// IPv4
+		0x45, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00,
+		0x40, 0x06, 0x00, 0x00, 0xc0, 0x00, 0x02, 0x01,
+		0xc6, 0x33, 0x64, 0x01,
+		// TCP
+		0x9c, 0x40, 0x00, 0x50, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x50, 0x00, 0xff, 0xff,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	if reply {
+		copy(b[12:16], []byte{0xc6, 0x33, 0x64, 0x01})
+		copy(b[16:20], []byte{0xc0, 0x00, 0x02, 0x01})
+		copy(b[20:24], []byte{0x00, 0x50, 0x9c, 0x40})
+	}
+	binary.BigEndian.PutUint32(b[24:28], seq)
+	binary.BigEndian.PutUint32(b[28:32], ack)
+	b[33] = byte(flags)
+	b = append(b, data...)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
+
+type testPacket struct {
+	reply bool
+	seq   uint32
+	ack   uint32
+	flags header.TCPFlags
+	data  string
+	// expected verdict, -1 if the packet is held
+	verdict nfqueue.Verdict
+}
+
+const held = -1
+
+func runTestPackets(t *testing.T, a *Assembler, v *testVerdicter, packets []testPacket) {
+	t.Helper()
+	for i, p := range packets {
+		if err := a.Handle(uint32(i), testSegment(p.reply, p.seq, p.ack, p.flags, p.data), header.FamilyIPv4); err != nil {
+			t.Fatalf("packet %d: unexpected error: %v", i, err)
+		}
+	}
+	for i, p := range packets {
+		verdict, ok := v.get(uint32(i))
+		switch {
+		case p.verdict == held && ok:
+			t.Errorf("packet %d: unexpected verdict %d", i, verdict)
+		case p.verdict != held && (!ok || verdict != p.verdict):
+			t.Errorf("packet %d: unexpected verdict %d, %t", i, verdict, ok)
+		}
+	}
+}
+
+// requestLine holds the flow until the first line of the client arrived and
+// accepts it for GET requests.
+func requestLine(calls *int) HandlerFunc {
+	return func(s *Stream) Result {
+		*calls++
+		line, _, ok := bytes.Cut(s.Data, []byte("\r\n"))
+		if !ok {
+			return Result{Hold: true}
+		}
+		if bytes.HasPrefix(line, []byte("GET ")) {
+			return Result{Verdict: nfqueue.NfAccept, Final: true}
+		}
+		return Result{Verdict: nfqueue.NfDrop, Final: true}
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	const (
+		syn = header.TCPFlagSYN
+		ack = header.TCPFlagACK
+		fin = header.TCPFlagFIN | header.TCPFlagACK
+		psh = header.TCPFlagPSH | header.TCPFlagACK
+		rst = header.TCPFlagRST
+	)
+
+	tests := map[string]struct {
+		config  Config
+		packets []testPacket
+		calls   int
+	}{
+		"hold until request line": {
+			packets: []testPacket{
+				{seq: 100, flags: syn, verdict: nfqueue.NfAccept},
+				{reply: true, seq: 500, flags: syn | ack, verdict: nfqueue.NfAccept},
+				{seq: 101, flags: ack, verdict: nfqueue.NfAccept},
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfAccept},
+				{seq: 109, flags: psh, data: "TP/1.1\r\n", verdict: nfqueue.NfAccept},
+				{reply: true, seq: 501, flags: psh, data: "HTTP/1.1 200 OK\r\n", verdict: nfqueue.NfAccept},
+			},
+			calls: 2,
+		},
+		"out of order": {
+			packets: []testPacket{
+				{seq: 100, flags: syn, verdict: nfqueue.NfAccept},
+				{seq: 109, flags: psh, data: "TP/1.1\r\n", verdict: nfqueue.NfAccept},
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfAccept},
+			},
+			calls: 1,
+		},
+		"retransmission while held": {
+			packets: []testPacket{
+				{seq: 100, flags: syn, verdict: nfqueue.NfAccept},
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfAccept},
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfAccept},
+				{seq: 109, flags: psh, data: "TP/1.1\r\n", verdict: nfqueue.NfAccept},
+			},
+			calls: 2,
+		},
+		"drop": {
+			packets: []testPacket{
+				{seq: 100, flags: syn, verdict: nfqueue.NfAccept},
+				{seq: 101, flags: psh, data: "POST / HTTP/1.1\r\n", verdict: nfqueue.NfDrop},
+				{seq: 118, flags: ack, verdict: nfqueue.NfDrop},
+				{reply: true, seq: 501, flags: psh, data: "HTTP/1.1 200 OK\r\n", verdict: nfqueue.NfDrop},
+			},
+			calls: 1,
+		},
+		"held": {
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "GET / HT", verdict: held},
+				{seq: 117, flags: psh, data: "Host", verdict: held},
+			},
+			calls: 1,
+		},
+		"max bytes": {
+			config: Config{MaxBytes: 10, DefaultVerdict: nfqueue.NfDrop},
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfDrop},
+				{seq: 109, flags: psh, data: "TP/1.1\r\n", verdict: nfqueue.NfDrop},
+			},
+			calls: 1,
+		},
+		"closed": {
+			config: Config{DefaultVerdict: nfqueue.NfDrop},
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfDrop},
+				{seq: 109, flags: fin, verdict: nfqueue.NfDrop},
+			},
+			calls: 2,
+		},
+		"reset": {
+			config: Config{DefaultVerdict: nfqueue.NfDrop},
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfDrop},
+				{seq: 109, flags: rst, verdict: nfqueue.NfAccept},
+			},
+			calls: 1,
+		},
+		"reset by peer": {
+			config: Config{DefaultVerdict: nfqueue.NfDrop},
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "GET / HT", verdict: nfqueue.NfDrop},
+				{reply: true, ack: 109, flags: rst | ack, verdict: nfqueue.NfAccept},
+			},
+			calls: 1,
+		},
+		"spoofed reset": {
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "GET / HT", verdict: held},
+				{seq: 100000, flags: rst, verdict: nfqueue.NfAccept},
+				{reply: true, ack: 5000, flags: rst | ack, verdict: nfqueue.NfAccept},
+			},
+			calls: 1,
+		},
+		"spoofed reset after drop": {
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "POST / HTTP/1.1\r\n", verdict: nfqueue.NfDrop},
+				{seq: 100000, flags: rst, verdict: nfqueue.NfDrop},
+				{seq: 118, flags: psh, data: "GET / HTTP/1.1\r\n", verdict: nfqueue.NfDrop},
+			},
+			calls: 1,
+		},
+		"reset after drop": {
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "POST / HTTP/1.1\r\n", verdict: nfqueue.NfDrop},
+				{seq: 118, flags: rst, verdict: nfqueue.NfDrop},
+				{seq: 118, flags: psh, data: "GET / HTTP/1.1\r\n", verdict: nfqueue.NfDrop},
+			},
+			calls: 1,
+		},
+		"closed after drop": {
+			packets: []testPacket{
+				{seq: 101, flags: psh, data: "POST / HTTP/1.1\r\n", verdict: nfqueue.NfDrop},
+				{seq: 118, flags: fin, verdict: nfqueue.NfDrop},
+				{reply: true, seq: 500, flags: fin, verdict: nfqueue.NfDrop},
+				{seq: 119, flags: psh, data: "GET / HTTP/1.1\r\n", verdict: nfqueue.NfDrop},
+			},
+			calls: 1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var calls int
+			v := new(testVerdicter)
+			a := New(v, requestLine(&calls), tc.config)
+			runTestPackets(t, a, v, tc.packets)
+			if calls != tc.calls {
+				t.Errorf("handler called %d times, expected %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestAssemblerRetransmission(t *testing.T) {
+	const psh = header.TCPFlagPSH | header.TCPFlagACK
+
+	tests := map[string][]testPacket{
+		"overlapping": {
+			{seq: 101, flags: psh, data: "abcdefgh", verdict: nfqueue.NfAccept},
+			{seq: 105, flags: psh, data: "efghijkl", verdict: nfqueue.NfAccept},
+			{seq: 109, flags: psh, data: "ijklmnop", verdict: nfqueue.NfAccept},
+			{seq: 113, flags: psh, data: "mnopqrst", verdict: nfqueue.NfAccept},
+			{seq: 117, flags: psh, data: "qrstuvwx", verdict: nfqueue.NfAccept},
+		},
+		"same data": {
+			{seq: 101, flags: psh, data: "abcdefgh", verdict: nfqueue.NfAccept},
+			{seq: 101, flags: psh, data: "abcdefgh", verdict: nfqueue.NfAccept},
+			{seq: 105, flags: psh, data: "efgh", verdict: nfqueue.NfAccept},
+		},
+		"different data": {
+			{seq: 101, flags: psh, data: "abcdefgh", verdict: nfqueue.NfAccept},
+			{seq: 101, flags: psh, data: "abcdXfgh", verdict: nfqueue.NfDrop},
+			{seq: 105, flags: psh, data: "Xfgh", verdict: nfqueue.NfDrop},
+		},
+		"different overlapping data": {
+			{seq: 101, flags: psh, data: "abcdefgh", verdict: nfqueue.NfAccept},
+			{seq: 105, flags: psh, data: "eXghijkl", verdict: nfqueue.NfDrop},
+			{seq: 105, flags: psh, data: "efghijkl", verdict: nfqueue.NfAccept},
+		},
+		"data not retained": {
+			{seq: 101, flags: psh, data: "abcdefgh", verdict: nfqueue.NfAccept},
+			{seq: 109, flags: psh, data: "ijklmnop", verdict: nfqueue.NfAccept},
+			{seq: 101, flags: psh, data: "abcdefgh", verdict: nfqueue.NfDrop},
+			{seq: 109, flags: psh, data: "ijklmnop", verdict: nfqueue.NfAccept},
+		},
+	}
+
+	for name, packets := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := new(testVerdicter)
+			a := New(v, func(*Stream) Result {
+				return Result{Verdict: nfqueue.NfAccept}
+			}, Config{MaxBytes: 10, DefaultVerdict: nfqueue.NfDrop})
+			runTestPackets(t, a, v, packets)
+		})
+	}
+}
+
+func TestAssemblerClose(t *testing.T) {
+	var calls int
+	v := new(testVerdicter)
+	a := New(v, requestLine(&calls), Config{DefaultVerdict: nfqueue.NfDrop})
+	runTestPackets(t, a, v, []testPacket{
+		{seq: 101, flags: header.TCPFlagPSH, data: "GET", verdict: held},
+	})
+	if err := a.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if verdict, ok := v.get(0); !ok || verdict != nfqueue.NfDrop {
+		t.Errorf("unexpected verdict %d, %t", verdict, ok)
+	}
+	if err := a.Handle(1, testSegment(false, 104, 0, 0, "x"), header.FamilyIPv4); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAssemblerLength(t *testing.T) {
+	var calls int
+	v := new(testVerdicter)
+	a := New(v, requestLine(&calls), Config{DefaultVerdict: nfqueue.NfDrop})
+	defer a.Close()
+
+	// A total length of 0 is used for packets larger than 64 KiB.
+	big := testSegment(false, 101, 0, header.TCPFlagPSH, "GET / HTTP/1.1\r\n")
+	binary.BigEndian.PutUint16(big[2:4], 0)
+	if err := a.Handle(0, big, header.FamilyIPv4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if verdict, ok := v.get(0); !ok || verdict != nfqueue.NfAccept {
+		t.Errorf("unexpected verdict %d, %t", verdict, ok)
+	}
+
+	short := testSegment(true, 501, 0, header.TCPFlagPSH, "HTTP/1.1 200 OK\r\n")
+	binary.BigEndian.PutUint16(short[2:4], 30)
+	if err := a.Handle(1, short, header.FamilyIPv4); !errors.Is(err, header.ErrInvalidHeader) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, ok := v.get(1); ok {
+		t.Error("unexpected verdict for packet with invalid length")
+	}
+}
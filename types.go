@@ -2,16 +2,30 @@ package nfqueue
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"time"
+
+	"github.com/mdlayher/netlink"
 )
 
 // Attribute contains various elements for nfqueue elements.
 // As not every value is contained in every nfqueue message,
 // the elements inside Attribute are pointers to these values
 // or nil, if not present.
+//
+// L2Hdr and VLAN are only provided for packets of the bridge family (NFPROTO_BRIDGE).
+// VLAN is set, if the VLAN tag is not part of L2Hdr.
+//
+// Exp is not set for packets queued by the kernel, as the kernel accepts
+// NFQA_EXP only in verdicts, see WithExpectation. Packets of connections, that
+// were created from an expectation, carry the master tuple in Conntrack.Master.
+//
+// Unknown holds the raw data of attributes, that are not supported by this
+// package, keyed by attribute type.
 type Attribute struct {
 	PacketID   *uint32
-	Hook       *uint8
+	Hook       *Hook
 	Timestamp  *time.Time
 	Mark       *uint32
 	InDev      *uint32
@@ -24,13 +38,44 @@ type Attribute struct {
 	GID        *uint32
 	SecCtx     *string
 	L2Hdr      *[]byte
-	HwAddr     *[]byte
+	HwAddr     *net.HardwareAddr
 	HwProtocol *uint16
 	Ct         *[]byte
-	CtInfo     *uint32
+	CtInfo     *CtInfo
 	SkbInfo    *[]byte
 	Exp        *[]byte
 	SkbPrio    *uint32
+	VLAN       *VLAN
+	Family     *uint8
+	QueueNum   *uint16
+	Unknown    map[uint16][]byte
+}
+
+// VLAN contains the VLAN tag of a packet as reported by the kernel via the
+// nested NFQA_VLAN attribute. The EtherType of the encapsulated protocol is
+// not part of the tag. For packets with a tag in VLAN, it is reported in
+// HwProtocol of Attribute.
+type VLAN struct {
+	// TPID is the tag protocol identifier, e.g. 0x8100 (802.1Q) or 0x88a8
+	// (802.1ad), as reported by NFQA_VLAN_PROTO.
+	TPID uint16
+	// TCI is the raw tag control information.
+	TCI uint16
+}
+
+// ID returns the VLAN identifier of the tag.
+func (v VLAN) ID() uint16 {
+	return v.TCI & 0x0fff
+}
+
+// Priority returns the priority code point of the tag.
+func (v VLAN) Priority() uint8 {
+	return uint8(v.TCI >> 13)
+}
+
+// DEI reports whether the drop eligible indicator of the tag is set.
+func (v VLAN) DEI() bool {
+	return v.TCI&0x1000 != 0
 }
 
 // HookFunc is a function, that receives events from a Netlinkgroup
@@ -39,8 +84,51 @@ type HookFunc func(a Attribute) int
 
 // ErrorFunc is a function that receives all errors that happen while reading
 // from a Netlinkgroup. To stop receiving messages return something different than 0.
+//
+// Messages, that could not be parsed, are reported as *ParseError.
 type ErrorFunc func(e error) int
 
+// ParseError is reported to the ErrorFunc, if a message of the kernel could
+// not be parsed.
+type ParseError struct {
+	// AttrType is the type of the attribute, that could not be parsed,
+	// or 0, if the error is not related to a specific attribute.
+	AttrType uint16
+	// PacketID is the ID of the affected packet, if HasPacketID is set.
+	PacketID    uint32
+	HasPacketID bool
+	Err         error
+}
+
+func (e *ParseError) Error() string {
+	msg := "could not parse message"
+	if e.HasPacketID {
+		msg = fmt.Sprintf("could not parse packet %d", e.PacketID)
+	}
+	if e.AttrType != 0 {
+		msg = fmt.Sprintf("%s: attribute 0x%x", msg, e.AttrType)
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParsePolicy defines the handling of packets, that could not be parsed.
+type ParsePolicy uint8
+
+// Policies for packets, that could not be parsed
+const (
+	// ParsePolicySkip skips the packet without verdict. The packet stays
+	// in the queue until it is full.
+	ParsePolicySkip ParsePolicy = iota
+	// ParsePolicyAccept accepts the packet, if its ID is known.
+	ParsePolicyAccept
+	// ParsePolicyDrop drops the packet, if its ID is known.
+	ParsePolicyDrop
+)
+
 // Config contains options for a Conn.
 type Config struct {
 	// Network namespace the Nfqueue needs to operate in. If set to 0 (default),
@@ -62,7 +150,8 @@ type Config struct {
 	// Optional flags for this Nfqueue socket.
 	Flags uint32
 
-	// AfFamily for this Nfqueue socket.
+	// AfFamily for this Nfqueue socket. Supported are AF_UNSPEC, AF_INET,
+	// AF_INET6 and NFPROTO_BRIDGE.
 	AfFamily uint8
 
 	// Deprecated: Cancel the context passed to RegisterWithErrorFunc() or Register()
@@ -74,6 +163,29 @@ type Config struct {
 
 	// Interface to log internals.
 	Logger Logger
+
+	// ZeroCopy avoids copying the packet data for every Attribute or Packet.
+	// If set, the byte slices of an Attribute or Packet refer to the receive
+	// buffer and their values are reused for the next packet. An Attribute or
+	// Packet and all of its values are therefore only valid until the HookFunc
+	// or PacketFunc returns and must be copied, if they are needed afterwards.
+	ZeroCopy bool
+
+	// ParsePolicy defines the verdict for packets, that could not be
+	// parsed. The default is ParsePolicySkip.
+	ParsePolicy ParsePolicy
+
+	// Batch enables the batching of verdicts, that are set via
+	// Nfqueue.Batcher().
+	Batch *BatchConfig
+
+	// AckVerdicts lets the kernel acknowledge every verdict. Setting a verdict
+	// waits for the acknowledgment and returns the error reported by the
+	// kernel, e.g. for unknown packet IDs or rejected altered packets.
+	// Acknowledgments are only received while a callback is registered.
+	// The wait for an acknowledgment is limited by WriteTimeout or, if it
+	// is not set, by DefaultAckTimeout.
+	AckVerdicts bool
 }
 
 // Various errors
@@ -81,8 +193,22 @@ var (
 	ErrRecvMsg        = errors.New("received error message")
 	ErrUnexpMsg       = errors.New("received unexpected message from kernel")
 	ErrInvFlag        = errors.New("invalid Flag")
+	ErrInvFamily      = errors.New("invalid family")
 	ErrNotLinux       = errors.New("not implemented for OS other than linux")
 	ErrInvalidVerdict = errors.New("invalid verdict")
+	ErrBatchOption    = errors.New("verdict option not supported for batch verdicts")
+	ErrAckTimeout     = errors.New("timeout waiting for acknowledgment")
+	ErrNotReceiving   = errors.New("not receiving acknowledgments")
+	ErrAckLost        = errors.New("acknowledgment might be lost")
+)
+
+// netlink message and attribute header
+// include/uapi/linux/netlink.h
+const (
+	nlmsgHeaderLen = 16
+	nlaHeaderLen   = 4
+	nlaAlignTo     = 4
+	nlaTypeMask    = ^uint16(netlink.Nested | netlink.NetByteOrder)
 )
 
 // nfLogSubSysQueue the netlink subsystem we will query
@@ -113,6 +239,13 @@ const (
 	nfQaPriority          /* skb->priority */
 )
 
+// nested attributes of nfQaVLAN
+const (
+	nfQaVLANUnspec = iota
+	nfQaVLANProto  /* __be16 skb vlan_proto */
+	nfQaVLANTCI    /* __be16 skb htons(vlan_tci) */
+)
+
 const (
 	_                  = iota
 	nfQaCfgCmd         /* nfqnl_msg_config_cmd */
@@ -139,6 +272,10 @@ const (
 )
 
 // Various configuration flags
+//
+// NfQaCfgFlagGSO lets the kernel queue GSO packets without segmenting them.
+// With this flag set, the kernel also reports the skb meta information, see
+// SkbInfo.
 const (
 	NfQaCfgFlagFailOpen  = (1 << iota)
 	NfQaCfgFlagConntrack = (1 << iota)
@@ -155,20 +292,112 @@ const (
 	NfQnlCopyPacket
 )
 
-// Verdicts
+// verdict word
+// include/uapi/linux/netfilter.h
 const (
-	NfDrop = iota
-	NfAccept
-	NfStolen
-	NfQeueue
-	NfRepeat
+	nfVerdictMask            = 0x000000ff // NF_VERDICT_MASK
+	nfVerdictFlagQueueBypass = 0x00008000 // NF_VERDICT_FLAG_QUEUE_BYPASS
+	nfVerdictQBits           = 16         // NF_VERDICT_QBITS
 )
 
 // conntrack attributes
 // include/uapi/linux/netfilter/nfnetlink_conntrack.h
 const (
-	ctaMark   = 8
-	ctaLabels = 22 // CTA_LABELS
+	ctaTupleOrig   = 1  // CTA_TUPLE_ORIG
+	ctaTupleReply  = 2  // CTA_TUPLE_REPLY
+	ctaStatus      = 3  // CTA_STATUS
+	ctaProtoInfo   = 4  // CTA_PROTOINFO
+	ctaHelp        = 5  // CTA_HELP
+	ctaTimeout     = 7  // CTA_TIMEOUT
+	ctaMark        = 8  // CTA_MARK
+	ctaUse         = 11 // CTA_USE
+	ctaID          = 12 // CTA_ID
+	ctaTupleMaster = 14 // CTA_TUPLE_MASTER
+	ctaZone        = 18 // CTA_ZONE
+	ctaSecCtx      = 19 // CTA_SECCTX
+	ctaLabels      = 22 // CTA_LABELS
+)
+
+// nested attributes of conntrack tuples
+const (
+	ctaTupleIP    = 1 // CTA_TUPLE_IP
+	ctaTupleProto = 2 // CTA_TUPLE_PROTO
+	ctaTupleZone  = 3 // CTA_TUPLE_ZONE
+)
+
+// nested attributes of CTA_TUPLE_IP
+const (
+	ctaIPv4Src = 1 // CTA_IP_V4_SRC
+	ctaIPv4Dst = 2 // CTA_IP_V4_DST
+	ctaIPv6Src = 3 // CTA_IP_V6_SRC
+	ctaIPv6Dst = 4 // CTA_IP_V6_DST
+)
+
+// nested attributes of CTA_TUPLE_PROTO
+const (
+	ctaProtoNum        = 1 // CTA_PROTO_NUM
+	ctaProtoSrcPort    = 2 // CTA_PROTO_SRC_PORT
+	ctaProtoDstPort    = 3 // CTA_PROTO_DST_PORT
+	ctaProtoIcmpID     = 4 // CTA_PROTO_ICMP_ID
+	ctaProtoIcmpType   = 5 // CTA_PROTO_ICMP_TYPE
+	ctaProtoIcmpCode   = 6 // CTA_PROTO_ICMP_CODE
+	ctaProtoIcmpv6ID   = 7 // CTA_PROTO_ICMPV6_ID
+	ctaProtoIcmpv6Type = 8 // CTA_PROTO_ICMPV6_TYPE
+	ctaProtoIcmpv6Code = 9 // CTA_PROTO_ICMPV6_CODE
+)
+
+// IP protocol numbers with protocol specific tuple attributes
+const (
+	protocolICMP   = 1  // IPPROTO_ICMP
+	protocolICMPv6 = 58 // IPPROTO_ICMPV6
+)
+
+// nested attributes of CTA_PROTOINFO
+const (
+	ctaProtoInfoTCP  = 1 // CTA_PROTOINFO_TCP
+	ctaProtoInfoDCCP = 2 // CTA_PROTOINFO_DCCP
+	ctaProtoInfoSCTP = 3 // CTA_PROTOINFO_SCTP
+)
+
+// nested attributes of CTA_PROTOINFO_TCP, CTA_PROTOINFO_DCCP and CTA_PROTOINFO_SCTP
+const (
+	ctaProtoInfoTCPState         = 1 // CTA_PROTOINFO_TCP_STATE
+	ctaProtoInfoTCPWScaleOrig    = 2 // CTA_PROTOINFO_TCP_WSCALE_ORIGINAL
+	ctaProtoInfoTCPWScaleReply   = 3 // CTA_PROTOINFO_TCP_WSCALE_REPLY
+	ctaProtoInfoTCPFlagsOrig     = 4 // CTA_PROTOINFO_TCP_FLAGS_ORIGINAL
+	ctaProtoInfoTCPFlagsReply    = 5 // CTA_PROTOINFO_TCP_FLAGS_REPLY
+	ctaProtoInfoDCCPState        = 1 // CTA_PROTOINFO_DCCP_STATE
+	ctaProtoInfoDCCPRole         = 2 // CTA_PROTOINFO_DCCP_ROLE
+	ctaProtoInfoSCTPState        = 1 // CTA_PROTOINFO_SCTP_STATE
+	ctaProtoInfoSCTPVTagOriginal = 2 // CTA_PROTOINFO_SCTP_VTAG_ORIGINAL
+	ctaProtoInfoSCTPVTagReply    = 3 // CTA_PROTOINFO_SCTP_VTAG_REPLY
+)
+
+// conntrack expectation attributes
+const (
+	ctaExpectMaster   = 1  // CTA_EXPECT_MASTER
+	ctaExpectTuple    = 2  // CTA_EXPECT_TUPLE
+	ctaExpectMask     = 3  // CTA_EXPECT_MASK
+	ctaExpectTimeout  = 4  // CTA_EXPECT_TIMEOUT
+	ctaExpectID       = 5  // CTA_EXPECT_ID
+	ctaExpectHelpName = 6  // CTA_EXPECT_HELP_NAME
+	ctaExpectZone     = 7  // CTA_EXPECT_ZONE
+	ctaExpectFlags    = 8  // CTA_EXPECT_FLAGS
+	ctaExpectClass    = 9  // CTA_EXPECT_CLASS
+	ctaExpectNAT      = 10 // CTA_EXPECT_NAT
+	ctaExpectFn       = 11 // CTA_EXPECT_FN
+)
+
+// nested attributes of CTA_EXPECT_NAT
+const (
+	ctaExpectNATDir   = 1 // CTA_EXPECT_NAT_DIR
+	ctaExpectNATTuple = 2 // CTA_EXPECT_NAT_TUPLE
+)
+
+// nested attributes of CTA_HELP and CTA_SECCTX
+const (
+	ctaHelpName   = 1 // CTA_HELP_NAME
+	ctaSecCtxName = 1 // CTA_SECCTX_NAME
 )
 
 // kernelDefaultMaxQueueLen is the default maximum queue length used by the kernel
@@ -1,29 +1,57 @@
 package nfqueue
 
-import (
-	"encoding/binary"
-	"fmt"
+import "fmt"
 
-	"github.com/mdlayher/netlink"
+// Verdict is the action the kernel takes for a queued packet.
+type Verdict int
+
+// Verdicts
+// include/uapi/linux/netfilter.h
+const (
+	NfDrop Verdict = iota
+	NfAccept
+	NfStolen
+	NfQueue
+	NfRepeat
 )
 
+// NfQeueue is the misspelled name of NfQueue.
+//
+// Deprecated: Use NfQueue instead.
+const NfQeueue = NfQueue
+
+var verdictNames = [...]string{
+	NfDrop:   "DROP",
+	NfAccept: "ACCEPT",
+	NfStolen: "STOLEN",
+	NfQueue:  "QUEUE",
+	NfRepeat: "REPEAT",
+}
+
+// String returns the name of the verdict.
+func (v Verdict) String() string {
+	if v.Valid() {
+		return verdictNames[v]
+	}
+	return fmt.Sprintf("Verdict(%d)", int(v))
+}
+
+// Valid reports whether v can be set for a queued packet.
+func (v Verdict) Valid() bool {
+	return v >= NfDrop && v <= NfRepeat
+}
+
 // VerdictOption configures additional verdict parameters like mark, label, or packet payload.
 type VerdictOption func(*verdictOptions) error
 
 type verdictOptions struct {
-	attrs   []netlink.Attribute
-	ctAttrs []netlink.Attribute
+	msg VerdictMessage
 }
 
 // WithMark sets the packet mark.
 func WithMark(mark uint32) VerdictOption {
 	return func(vo *verdictOptions) error {
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, mark)
-		vo.attrs = append(vo.attrs, netlink.Attribute{
-			Type: nfQaMark,
-			Data: buf,
-		})
+		vo.msg.Mark = &mark
 		return nil
 	}
 }
@@ -31,13 +59,10 @@ func WithMark(mark uint32) VerdictOption {
 // WithConnMark sets the packet connmark.
 func WithConnMark(mark uint32) VerdictOption {
 	return func(vo *verdictOptions) error {
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, mark)
-		// collect conntrack attributes; will be nested under nfQaCt later
-		vo.ctAttrs = append(vo.ctAttrs, netlink.Attribute{
-			Type: ctaMark,
-			Data: buf,
-		})
+		if vo.msg.Batch {
+			return fmt.Errorf("connmark: %w", ErrBatchOption)
+		}
+		vo.msg.ConnMark = &mark
 		return nil
 	}
 }
@@ -45,14 +70,30 @@ func WithConnMark(mark uint32) VerdictOption {
 // WithLabel sets the packet label.
 func WithLabel(label []byte) VerdictOption {
 	return func(vo *verdictOptions) error {
+		if vo.msg.Batch {
+			return fmt.Errorf("label: %w", ErrBatchOption)
+		}
 		if len(label) != 16 {
 			return fmt.Errorf("conntrack CTA_LABELS must be 16 bytes, got %d", len(label))
 		}
-		// collect conntrack attributes; will be nested under nfQaCt later
-		vo.ctAttrs = append(vo.ctAttrs, netlink.Attribute{
-			Type: ctaLabels,
-			Data: label,
-		})
+		vo.msg.Label = label
+		return nil
+	}
+}
+
+// WithExpectation attaches exp to the conntrack entry of the packet. The queue
+// has to be configured with NfQaCfgFlagConntrack, as the kernel ignores the
+// expectation for packets without conntrack entry. Tuple and Mask of exp are
+// required.
+func WithExpectation(exp Expectation) VerdictOption {
+	return func(vo *verdictOptions) error {
+		if vo.msg.Batch {
+			return fmt.Errorf("expectation: %w", ErrBatchOption)
+		}
+		if exp.Tuple == nil || exp.Mask == nil {
+			return errExpectationTuple
+		}
+		vo.msg.Expectation = &exp
 		return nil
 	}
 }
@@ -60,40 +101,71 @@ func WithLabel(label []byte) VerdictOption {
 // WithAlteredPacket sets the altered packet payload.
 func WithAlteredPacket(packet []byte) VerdictOption {
 	return func(vo *verdictOptions) error {
-		vo.attrs = append(vo.attrs, netlink.Attribute{
-			Type: nfQaPayload,
-			Data: packet,
-		})
+		if vo.msg.Batch {
+			return fmt.Errorf("altered packet: %w", ErrBatchOption)
+		}
+		vo.msg.Payload = packet
+		return nil
+	}
+}
+
+// WithTargetQueue passes the packet on to the queue num. If bypass is set,
+// the packet is accepted, if no program is listening on num. It can only be
+// used with the verdict NfQueue.
+func WithTargetQueue(num uint16, bypass bool) VerdictOption {
+	return func(vo *verdictOptions) error {
+		if vo.msg.Verdict != NfQueue {
+			return fmt.Errorf("target queue requires verdict NfQueue: %w", ErrInvalidVerdict)
+		}
+		vo.msg.TargetQueue = num
+		vo.msg.Bypass = bypass
 		return nil
 	}
 }
 
 // SetVerdictWithOption signals the kernel the next action for a specified packet id
-// and applies any number of verdict options like WithMark, WithLabel, WithPacket.
+// and applies any number of verdict options like WithMark, WithLabel, WithAlteredPacket
+// or WithTargetQueue.
+//
+// Deprecated: Use SetPacketVerdict() instead.
 func (nfqueue *Nfqueue) SetVerdictWithOption(id uint32, verdict int, options ...VerdictOption) error {
-	vo := &verdictOptions{}
+	return nfqueue.SetPacketVerdict(id, Verdict(verdict), options...)
+}
+
+// SetPacketVerdict signals the kernel the next action for a specified packet id
+// and applies any number of verdict options like WithMark, WithLabel, WithAlteredPacket
+// or WithTargetQueue.
+func (nfqueue *Nfqueue) SetPacketVerdict(id uint32, verdict Verdict, options ...VerdictOption) error {
+	vo := &verdictOptions{msg: VerdictMessage{ID: id, Verdict: verdict}}
 	for _, opt := range options {
 		if err := opt(vo); err != nil {
 			return err
 		}
 	}
+	return nfqueue.setPacketVerdict(vo.msg)
+}
 
-	// If conntrack attributes were provided, nest them under nfQaCt
-	if len(vo.ctAttrs) > 0 {
-		ctData, err := netlink.MarshalAttributes(vo.ctAttrs)
-		if err != nil {
+// SetPacketVerdictBatch signals the kernel the next action for a batch of packets
+// till id and applies verdict options. The kernel supports only WithMark and
+// WithTargetQueue for batch verdicts, other options return ErrBatchOption.
+func (nfqueue *Nfqueue) SetPacketVerdictBatch(id uint32, verdict Verdict, options ...VerdictOption) error {
+	vo := &verdictOptions{msg: VerdictMessage{ID: id, Verdict: verdict, Batch: true}}
+	for _, opt := range options {
+		if err := opt(vo); err != nil {
 			return err
 		}
-		vo.attrs = append(vo.attrs, netlink.Attribute{
-			Type: netlink.Nested | nfQaCt,
-			Data: ctData,
-		})
 	}
+	return nfqueue.setPacketVerdict(vo.msg)
+}
 
-	data, err := netlink.MarshalAttributes(vo.attrs)
-	if err != nil {
+// setPacketVerdict sends a verdict, that was not set via the Batcher, and
+// removes the packets it covers from the Batcher.
+func (nfqueue *Nfqueue) setPacketVerdict(msg VerdictMessage) error {
+	if err := nfqueue.setVerdict(msg); err != nil {
 		return err
 	}
-
-	return nfqueue.setVerdict(id, verdict, false, data)
+	if nfqueue.batcher != nil {
+		return nfqueue.batcher.forget(msg.ID, msg.Batch)
+	}
+	return nil
 }
@@ -0,0 +1,63 @@
+package nfqueue
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerdict(t *testing.T) {
+	tests := map[string]struct {
+		verdict Verdict
+		name    string
+		valid   bool
+	}{
+		"drop":     {verdict: NfDrop, name: "DROP", valid: true},
+		"queue":    {verdict: NfQueue, name: "QUEUE", valid: true},
+		"repeat":   {verdict: NfRepeat, name: "REPEAT", valid: true},
+		"stop":     {verdict: 5, name: "Verdict(5)"},
+		"negative": {verdict: -1, name: "Verdict(-1)"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if s := tc.verdict.String(); s != tc.name {
+				t.Errorf("unexpected name: %s", s)
+			}
+			if valid := tc.verdict.Valid(); valid != tc.valid {
+				t.Errorf("unexpected validity: %t", valid)
+			}
+		})
+	}
+}
+
+func TestVerdictOptionBatch(t *testing.T) {
+	tests := map[string]struct {
+		option  VerdictOption
+		wantErr bool
+	}{
+		"mark":           {option: WithMark(1)},
+		"target queue":   {option: WithTargetQueue(2, false)},
+		"connmark":       {option: WithConnMark(1), wantErr: true},
+		"label":          {option: WithLabel(make([]byte, 16)), wantErr: true},
+		"altered packet": {option: WithAlteredPacket([]byte{0x45}), wantErr: true},
+		"expectation":    {option: WithExpectation(Expectation{Tuple: &ConntrackTuple{}, Mask: &ConntrackTuple{}}), wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			vo := &verdictOptions{msg: VerdictMessage{ID: 42, Verdict: NfQueue, Batch: true}}
+			err := tc.option(vo)
+			if errors.Is(err, ErrBatchOption) != tc.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// The deprecated methods keep their signatures with the verdict as int.
+var (
+	_ func(*Nfqueue, uint32, int) error                   = (*Nfqueue).SetVerdict
+	_ func(*Nfqueue, uint32, int) error                   = (*Nfqueue).SetVerdictBatch
+	_ func(*Nfqueue, uint32, int, int) error              = (*Nfqueue).SetVerdictWithMark
+	_ func(*Nfqueue, uint32, int, ...VerdictOption) error = (*Nfqueue).SetVerdictWithOption
+)